@@ -17,47 +17,297 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// +kubebuilder:validation:Enum=save;push;exportRootfs
 type OperatorType string
 type LocalHostPath string
 
 const (
 	Save OperatorType = "save"
 	Push OperatorType = "push"
+	// ExportRootfs writes the flattened filesystem of the image as a tar to the host path.
+	ExportRootfs OperatorType = "exportRootfs"
 )
 
+// OperationStatus is the result of an operation of the build.
+type OperationStatus struct {
+	Operation OperatorType `json:"operation" yaml:"operation"`
+	// State is Running, Succeeded or Failed.
+	State          string       `json:"state,omitempty" yaml:"state,omitempty"`
+	Message        string       `json:"message,omitempty" yaml:"message,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty" yaml:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty" yaml:"completionTime,omitempty"`
+}
+
+// FailureReason classifies why a build failed.
+// +kubebuilder:validation:Enum=AuthDenied;RegistryUnavailable;ContainerNotFound;DiskFull;PolicyViolation;Timeout;Unknown
+type FailureReason string
+
+const (
+	FailureAuthDenied          FailureReason = "AuthDenied"
+	FailureRegistryUnavailable FailureReason = "RegistryUnavailable"
+	FailureContainerNotFound   FailureReason = "ContainerNotFound"
+	FailureDiskFull            FailureReason = "DiskFull"
+	FailurePolicyViolation     FailureReason = "PolicyViolation"
+	FailureTimeout             FailureReason = "Timeout"
+	FailureUnknown             FailureReason = "Unknown"
+)
+
+// RetryPolicy controls how the builder job retries a failed commit, push or save. A failed
+// push or save is retried on its own, without committing again.
+type RetryPolicy struct {
+	// MaxAttempts of every step, including the first one. Defaults to 3.
+	MaxAttempts int32 `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+	// Backoff before the first retry, doubled for every further retry. Defaults to 10s.
+	Backoff *metav1.Duration `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+	// RetryOn are the failure reasons that are retried. Defaults to RegistryUnavailable.
+	RetryOn []FailureReason `json:"retryOn,omitempty" yaml:"retryOn,omitempty"`
+}
+
+// TargetReference selects the pod of a workload.
+type TargetReference struct {
+	// Kind is one of Deployment, StatefulSet or ReplicaSet.
+	Kind string `json:"kind" yaml:"kind"`
+	Name string `json:"name" yaml:"name"`
+	// Ordinal selects the pod <name>-<ordinal> of a StatefulSet.
+	Ordinal *int32 `json:"ordinal,omitempty" yaml:"ordinal,omitempty"`
+}
+
+// SquashMode selects the layers merged into one.
+// +kubebuilder:validation:Enum=all;onBase
+type SquashMode string
+
+const (
+	// SquashAll flattens the image into a single layer.
+	SquashAll SquashMode = "all"
+	// SquashOnBase merges all layers above the image the container was started from.
+	SquashOnBase SquashMode = "onBase"
+)
+
+// CommitHook is a command executed in the target container around the commit.
+type CommitHook struct {
+	// Command is executed without a shell, e.g. ["sh", "-c", "redis-cli save"].
+	Command []string `json:"command" yaml:"command"`
+	// Timeout of the command, e.g. "1m". A preCommitHook is bounded by the timeout of the build by
+	// default. A postCommitHook also runs after the build timed out and defaults to 5m.
+	Timeout *metav1.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// RegistryTLS configures the connection to a registry. Registries are accessed with HTTPS and
+// verified against the system CAs by default.
+type RegistryTLS struct {
+	// InsecureSkipVerify accepts any certificate of the registry. The registry must be listed in
+	// the insecureRegistries of an ImageBuilderPolicy.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+	// PlainHTTP talks to the registry without TLS. The registry must be listed in the
+	// insecureRegistries of an ImageBuilderPolicy.
+	PlainHTTP bool `json:"plainHTTP,omitempty" yaml:"plainHTTP,omitempty"`
+	// CA is a PEM bundle of certificate authorities trusted in addition to the system ones. Only
+	// supported with containerd, docker pushes with the certificates configured in the daemon and
+	// a build pushing with a CA fails on a docker node before the commit.
+	CA *CASource `json:"ca,omitempty" yaml:"ca,omitempty"`
+	// ClientCertSecretRef references a kubernetes.io/tls Secret in the namespace of the
+	// ImageBuilder, its certificate authenticates the push. Only supported with containerd, like
+	// ca it fails the build on a docker node before the commit.
+	ClientCertSecretRef *corev1.LocalObjectReference `json:"clientCertSecretRef,omitempty" yaml:"clientCertSecretRef,omitempty"`
+}
+
+// Insecure tells whether the registry is accessed without verified TLS.
+func (in *RegistryTLS) Insecure() bool {
+	return in != nil && (in.PlainHTTP || in.InsecureSkipVerify)
+}
+
+// CASource selects a key of a ConfigMap or a Secret holding a PEM bundle, exactly one must be set.
+type CASource struct {
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty" yaml:"configMapKeyRef,omitempty"`
+	SecretKeyRef    *corev1.SecretKeySelector    `json:"secretKeyRef,omitempty" yaml:"secretKeyRef,omitempty"`
+}
+
+// Destination is a registry the committed image is pushed to.
+type Destination struct {
+	// To is the image reference, e.g. registry.example.com/team/app:v1.
+	To string `json:"to" yaml:"to"`
+	// CredentialsSecretRef references a kubernetes.io/dockerconfigjson or kubernetes.io/basic-auth
+	// Secret in the namespace of the ImageBuilder. Without it the pull secrets of the source pod
+	// are used when spec.usePodPullSecrets is set, otherwise the push is anonymous.
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty" yaml:"credentialsSecretRef,omitempty"`
+	// TLS of the registry.
+	TLS *RegistryTLS `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+// DestinationStatus is the result of the push to a destination.
+type DestinationStatus struct {
+	To string `json:"to" yaml:"to"`
+	// State is Succeeded or Failed.
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+	// Digest is the digest of the pushed manifest.
+	Digest  string `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+}
+
+// AddFile adds a key of a ConfigMap or Secret in the namespace of the ImageBuilder to the image.
+// Exactly one of ConfigMapKeyRef and SecretKeyRef must be set, the creator of the ImageBuilder must
+// be allowed to get it.
+type AddFile struct {
+	// Path is the absolute path of the file in the image.
+	Path string `json:"path" yaml:"path"`
+	// Mode of the file, e.g. 0644. Defaults to 0644.
+	Mode            *int32                       `json:"mode,omitempty" yaml:"mode,omitempty"`
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty" yaml:"configMapKeyRef,omitempty"`
+	SecretKeyRef    *corev1.SecretKeySelector    `json:"secretKeyRef,omitempty" yaml:"secretKeyRef,omitempty"`
+}
+
+// CommitSpec configures the image created from the container.
+type CommitSpec struct {
+	// Changes are Dockerfile instructions applied to the image config, e.g. `CMD ["nginx"]` or
+	// `ENV DEBUG=false`. Supported are CMD, ENTRYPOINT, ENV, EXPOSE, LABEL, STOPSIGNAL, USER,
+	// VOLUME and WORKDIR.
+	Changes []string `json:"changes,omitempty" yaml:"changes,omitempty"`
+	// Author of the commit, e.g. "Jane Doe <jane@example.com>".
+	Author string `json:"author,omitempty" yaml:"author,omitempty"`
+	// Message of the commit, recorded in the image history.
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+	// KeepEnv are glob patterns of environment variables kept in the image although they were
+	// injected by kubernetes or the pod spec, e.g. "JAVA_OPTS" or "APP_*". By default the env of
+	// the image is reset to the env of the image the container was created from. Only docker
+	// commits the env of the container, containerd keeps the env of the image anyway.
+	KeepEnv []string `json:"keepEnv,omitempty" yaml:"keepEnv,omitempty"`
+	// PreserveImageConfig resets Entrypoint, Cmd, WorkingDir and User to the values of the image
+	// the container was started from, dropping the command and args of the pod. Changes still apply.
+	PreserveImageConfig bool `json:"preserveImageConfig,omitempty" yaml:"preserveImageConfig,omitempty"`
+	// ExcludePaths are glob patterns of absolute paths removed from the committed layer together
+	// with everything below them, e.g. "/app/logs" or "/data/*.tmp".
+	ExcludePaths []string `json:"excludePaths,omitempty" yaml:"excludePaths,omitempty"`
+	// DisableDefaultExcludePaths keeps the paths excluded by default: the service account token,
+	// shell histories, the caches of root and the home directories, /tmp and /var/tmp.
+	DisableDefaultExcludePaths bool `json:"disableDefaultExcludePaths,omitempty" yaml:"disableDefaultExcludePaths,omitempty"`
+	// Squash merges the layers of the image including the added files, either all of them into
+	// a single layer or the ones above the image the container was started from.
+	Squash SquashMode `json:"squash,omitempty" yaml:"squash,omitempty"`
+	// Pause freezes the container while its filesystem is committed, so the layer is consistent.
+	// Defaults to true, disable it for latency sensitive services.
+	Pause *bool `json:"pause,omitempty" yaml:"pause,omitempty"`
+	// PreCommitHook runs before the commit, e.g. to flush a database or stop a writer. The commit
+	// is not done when it fails.
+	PreCommitHook *CommitHook `json:"preCommitHook,omitempty" yaml:"preCommitHook,omitempty"`
+	// PostCommitHook runs after the commit and the unpause, also when the commit or the pre commit
+	// hook failed.
+	PostCommitHook *CommitHook `json:"postCommitHook,omitempty" yaml:"postCommitHook,omitempty"`
+}
+
+// PauseContainer tells whether the container is paused during the commit.
+func (c *CommitSpec) PauseContainer() bool {
+	return c == nil || c.Pause == nil || *c.Pause
+}
+
 type ImageBuilderSpec struct {
-	PodName       string        `json:"podName,omitempty" yaml:"podName,omitempty"`
-	Namespace     string        `json:"namespace,omitempty" yaml:"namespace,omitempty"`
-	ContainerName string        `json:"containerName,omitempty" yaml:"containerName,omitempty"`
-	Username      string        `json:"username,omitempty" yaml:"username,omitempty"`
-	Password      string        `json:"password,omitempty" yaml:"password,omitempty"`
-	To            string        `json:"to,omitempty" yaml:"to,omitempty"`
+	// Exactly one of PodName, TargetRef and Selector selects the pod to commit.
+	PodName string `json:"podName,omitempty" yaml:"podName,omitempty"`
+	// TargetRef selects the single running pod of a workload.
+	TargetRef *TargetReference `json:"targetRef,omitempty" yaml:"targetRef,omitempty"`
+	// Selector selects the single running pod matching the labels.
+	Selector      *metav1.LabelSelector `json:"selector,omitempty" yaml:"selector,omitempty"`
+	Namespace     string                `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	ContainerName string                `json:"containerName,omitempty" yaml:"containerName,omitempty"`
+	// Deprecated: use CredentialsSecretRef instead.
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	// Deprecated: use CredentialsSecretRef instead.
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	To       string `json:"to,omitempty" yaml:"to,omitempty"`
+	// Operator is the single operation of the build, ignored when Operations is set.
 	Operator      OperatorType  `json:"operator,omitempty" yaml:"operator,omitempty"`
 	LocalHostPath LocalHostPath `json:"localHostPath,omitempty" yaml:"localHostPath,omitempty"`
+	// CredentialsSecretRef references a kubernetes.io/dockerconfigjson or kubernetes.io/basic-auth
+	// Secret in the namespace of the ImageBuilder, used to authenticate against the registry of To.
+	// It takes precedence over Username and Password.
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty" yaml:"credentialsSecretRef,omitempty"`
+	// TLS of the registry of To.
+	TLS *RegistryTLS `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// UsePodPullSecrets pushes with the imagePullSecrets of the source pod and its ServiceAccount
+	// when neither CredentialsSecretRef nor Username is set. The creator must be allowed to get
+	// these Secrets, like the ones referenced by CredentialsSecretRef.
+	UsePodPullSecrets bool `json:"usePodPullSecrets,omitempty" yaml:"usePodPullSecrets,omitempty"`
+	// TTLSecondsAfterFinished deletes the ImageBuilder the given seconds after it succeeded or failed.
+	// Defaults to the --ttl-seconds-after-finished flag of the controller.
+	TTLSecondsAfterFinished *int32       `json:"ttlSecondsAfterFinished,omitempty" yaml:"ttlSecondsAfterFinished,omitempty"`
+	RetryPolicy             *RetryPolicy `json:"retryPolicy,omitempty" yaml:"retryPolicy,omitempty"`
+	// Timeout of the whole build including retries, e.g. "30m". The build fails with the
+	// Timeout reason when it expires. No timeout by default.
+	Timeout *metav1.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Commit  *CommitSpec      `json:"commit,omitempty" yaml:"commit,omitempty"`
+	// AddFiles are added to the image in an extra layer on top of the committed one.
+	AddFiles []AddFile `json:"addFiles,omitempty" yaml:"addFiles,omitempty"`
+	// Destinations are pushed with the image committed once. They replace To, Username, Password
+	// and CredentialsSecretRef for the push, To then only names the committed image and defaults
+	// to the first destination.
+	Destinations []Destination `json:"destinations,omitempty" yaml:"destinations,omitempty"`
+	// Operations run in order on the image committed once, e.g. [push, save]. The build stops at
+	// the first failed operation.
+	Operations []OperatorType `json:"operations,omitempty" yaml:"operations,omitempty"`
 }
 
 type ImageBuilderStatus struct {
 	State  string `json:"state,omitempty" yaml:"state,omitempty"`
 	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
 	Node   string `json:"node,omitempty" yaml:"node,omitempty"`
+	// FailureReason classifies the error of a failed build.
+	FailureReason FailureReason `json:"failureReason,omitempty" yaml:"failureReason,omitempty"`
+	// PodName is the pod chosen for the build.
+	PodName string `json:"podName,omitempty" yaml:"podName,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was computed for.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty" yaml:"observedGeneration,omitempty"`
+	// StartTime is the time the controller started to handle the request.
+	StartTime *metav1.Time `json:"startTime,omitempty" yaml:"startTime,omitempty"`
+	// CompletionTime is the time the request reached Succeeded or Failed.
+	CompletionTime *metav1.Time `json:"completionTime,omitempty" yaml:"completionTime,omitempty"`
+	// Image describes the image produced by the build.
+	Image *ImageStatus `json:"image,omitempty" yaml:"image,omitempty"`
+	// Operations reports every started operation.
+	Operations []OperationStatus `json:"operations,omitempty" yaml:"operations,omitempty"`
+	// Destinations reports the push to every destination.
+	Destinations []DestinationStatus `json:"destinations,omitempty" yaml:"destinations,omitempty"`
+	// Conditions are Scheduled, Committed, Pushed, Saved or RootfsExported for the operations, and Ready.
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+}
+
+// ImageStatus describes a committed image. Sizes are in bytes as reported by the container runtime,
+// compressed for containerd and uncompressed for docker.
+type ImageStatus struct {
+	// Reference is the fully qualified reference, e.g. docker.io/library/nginx:latest.
+	Reference string `json:"reference,omitempty" yaml:"reference,omitempty"`
+	// Digest is the manifest digest, the image can be pinned as <repository>@<digest>.
+	// It is empty for docker until the image has been pushed.
+	Digest       string `json:"digest,omitempty" yaml:"digest,omitempty"`
+	ConfigDigest string `json:"configDigest,omitempty" yaml:"configDigest,omitempty"`
+	Size         int64  `json:"size,omitempty" yaml:"size,omitempty"`
+	// NewLayerSize is the size of the top layer of the image. It is the layer added by the commit
+	// unless commit.addFiles adds its layer on top, or commit.squash merges it with the layers below.
+	NewLayerSize int64 `json:"newLayerSize,omitempty" yaml:"newLayerSize,omitempty"`
+	Layers       int   `json:"layers,omitempty" yaml:"layers,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
-// +kubebuilder:printcolumn:name="PodName",type=string,JSONPath=`.spec.podName`
+// +kubebuilder:printcolumn:name="PodName",type=string,JSONPath=`.status.podName`
 // +kubebuilder:printcolumn:name="PodNamespace",type=string,JSONPath=`.spec.namespace`
 // +kubebuilder:printcolumn:name="ContainerName",type=string,JSONPath=`.spec.containerName`
 // +kubebuilder:printcolumn:name="To",type=string,JSONPath=`.spec.to`
 // +kubebuilder:printcolumn:name="State",type=string,JSONPath=`.status.state`
 // +kubebuilder:printcolumn:name="Node",type=string,JSONPath=`.status.node`
+// +kubebuilder:printcolumn:name="Digest",type=string,JSONPath=`.status.image.digest`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 type ImageBuilder struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -89,3 +339,86 @@ func (l LocalHostPath) DefaultNodePath() string {
 	}
 	return "/tmp/imagebuilder"
 }
+
+// SetCondition adds or updates the condition of the given type, stamped with the current generation.
+func (in *ImageBuilder) SetCondition(conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&in.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: in.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// OperationList returns spec.operations, or spec.operator which defaults to push.
+func (in *ImageBuilderSpec) OperationList() []OperatorType {
+	if len(in.Operations) > 0 {
+		return in.Operations
+	}
+	if in.Operator == "" {
+		return []OperatorType{Push}
+	}
+	return []OperatorType{in.Operator}
+}
+
+// HasOperation tells whether the build runs operation.
+func (in *ImageBuilderSpec) HasOperation(operation OperatorType) bool {
+	for _, o := range in.OperationList() {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// CommitReference is the reference the container is committed to.
+func (in *ImageBuilderSpec) CommitReference() string {
+	if in.To == "" && len(in.Destinations) > 0 {
+		return in.Destinations[0].To
+	}
+	return in.To
+}
+
+// PushDestinations are the destinations the committed image is pushed to, spec.destinations or
+// spec.to with spec.credentialsSecretRef and spec.tls.
+func (in *ImageBuilderSpec) PushDestinations() []Destination {
+	if len(in.Destinations) > 0 {
+		return in.Destinations
+	}
+	return []Destination{{To: in.To, CredentialsSecretRef: in.CredentialsSecretRef, TLS: in.TLS}}
+}
+
+// TargetPodName returns the pod chosen for the build, falling back to spec.podName before it was resolved.
+func (in *ImageBuilder) TargetPodName() string {
+	if in.Status.PodName != "" {
+		return in.Status.PodName
+	}
+	return in.Spec.PodName
+}
+
+func (in *RetryPolicy) Attempts() int {
+	if in == nil || in.MaxAttempts <= 0 {
+		return 3
+	}
+	return int(in.MaxAttempts)
+}
+
+func (in *RetryPolicy) InitialBackoff() time.Duration {
+	if in == nil || in.Backoff == nil {
+		return 10 * time.Second
+	}
+	return in.Backoff.Duration
+}
+
+func (in *RetryPolicy) Retries(reason FailureReason) bool {
+	if in == nil || len(in.RetryOn) == 0 {
+		return reason == FailureRegistryUnavailable
+	}
+	for _, r := range in.RetryOn {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
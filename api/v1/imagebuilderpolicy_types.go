@@ -0,0 +1,77 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NamespaceRule allows ImageBuilders in Namespaces to snapshot pods in PodNamespaces.
+type NamespaceRule struct {
+	// Namespaces are glob patterns of the namespaces the ImageBuilder is created in.
+	Namespaces []string `json:"namespaces" yaml:"namespaces"`
+	// PodNamespaces are glob patterns of the namespaces of the target pods.
+	// Empty only allows pods of the ImageBuilder's own namespace.
+	PodNamespaces []string `json:"podNamespaces,omitempty" yaml:"podNamespaces,omitempty"`
+	// PodSelector further restricts the target pods by label.
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty" yaml:"podSelector,omitempty"`
+}
+
+// ImageBuilderPolicySpec restricts what ImageBuilders may do. An ImageBuilder must be allowed by
+// every policy, an empty field does not restrict anything.
+type ImageBuilderPolicySpec struct {
+	// AllowedDestinations are glob patterns matched against <registry>/<repository> of spec.to,
+	// e.g. "registry.example.com/team-a/*" or "docker.io/library/nginx".
+	AllowedDestinations []string `json:"allowedDestinations,omitempty" yaml:"allowedDestinations,omitempty"`
+	// AllowedHostPathPrefixes are the node directories spec.localHostPath may be in.
+	AllowedHostPathPrefixes []string `json:"allowedHostPathPrefixes,omitempty" yaml:"allowedHostPathPrefixes,omitempty"`
+	// NamespaceRules, when set, require an ImageBuilder to match at least one rule.
+	NamespaceRules []NamespaceRule `json:"namespaceRules,omitempty" yaml:"namespaceRules,omitempty"`
+	// InsecureRegistries are glob patterns of registry hosts, e.g. "registry.local:5000" or
+	// "*.internal", which ImageBuilders may push to with plainHTTP or insecureSkipVerify. Without
+	// a policy listing it, every registry is accessed with verified HTTPS.
+	InsecureRegistries []string `json:"insecureRegistries,omitempty" yaml:"insecureRegistries,omitempty"`
+	// MaxImageSize is the largest committed image allowed, as reported by the container runtime.
+	MaxImageSize *resource.Quantity `json:"maxImageSize,omitempty" yaml:"maxImageSize,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// +kubebuilder:printcolumn:name="MaxImageSize",type=string,JSONPath=`.spec.maxImageSize`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type ImageBuilderPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ImageBuilderPolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ImageBuilderPolicyList contains a list of ImageBuilderPolicy
+type ImageBuilderPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageBuilderPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageBuilderPolicy{}, &ImageBuilderPolicyList{})
+}
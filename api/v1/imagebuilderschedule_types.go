@@ -0,0 +1,140 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type ConcurrencyPolicy string
+
+const (
+	// AllowConcurrent allows runs to overlap.
+	AllowConcurrent ConcurrencyPolicy = "Allow"
+	// ForbidConcurrent skips a run while the previous one is still active.
+	ForbidConcurrent ConcurrencyPolicy = "Forbid"
+	// ReplaceConcurrent deletes the active run and starts a new one.
+	ReplaceConcurrent ConcurrencyPolicy = "Replace"
+)
+
+// ImageBuilderTemplateSpec describes the ImageBuilder created for each run.
+type ImageBuilderTemplateSpec struct {
+	// Labels and annotations of the created ImageBuilder.
+	Metadata ImageBuilderTemplateMeta `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	Spec     ImageBuilderSpec         `json:"spec" yaml:"spec"`
+}
+
+type ImageBuilderTemplateMeta struct {
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+}
+
+type ImageBuilderScheduleSpec struct {
+	// Schedule in cron format, e.g. "0 2 * * *" or "@daily". Runs start at most once a minute, an
+	// "@every" interval must be at least 1m.
+	Schedule string `json:"schedule" yaml:"schedule"`
+	// Suspend stops creating new runs, active runs are not affected.
+	Suspend bool `json:"suspend,omitempty" yaml:"suspend,omitempty"`
+	// ConcurrencyPolicy is one of Allow, Forbid or Replace. Defaults to Forbid.
+	// +kubebuilder:validation:Enum=Allow;Forbid;Replace
+	ConcurrencyPolicy ConcurrencyPolicy `json:"concurrencyPolicy,omitempty" yaml:"concurrencyPolicy,omitempty"`
+	// SuccessfulHistoryLimit is the number of succeeded runs to keep. Defaults to 3.
+	SuccessfulHistoryLimit *int32 `json:"successfulHistoryLimit,omitempty" yaml:"successfulHistoryLimit,omitempty"`
+	// FailedHistoryLimit is the number of failed runs to keep. Defaults to 1.
+	FailedHistoryLimit *int32 `json:"failedHistoryLimit,omitempty" yaml:"failedHistoryLimit,omitempty"`
+	// TagTemplate is a go template rendered into the tag of template.spec.to for every run.
+	// Available fields are .ScheduleName, .Timestamp (20060102-150405), .Date (20060102) and .Unix.
+	// Defaults to "{{ .Timestamp }}".
+	TagTemplate string                   `json:"tagTemplate,omitempty" yaml:"tagTemplate,omitempty"`
+	Template    ImageBuilderTemplateSpec `json:"template" yaml:"template"`
+}
+
+type ImageBuilderScheduleStatus struct {
+	// Active are the names of the runs that are not finished yet.
+	Active []string `json:"active,omitempty" yaml:"active,omitempty"`
+	// LastScheduleTime is the scheduled time of the last run.
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty" yaml:"lastScheduleTime,omitempty"`
+	// LastSuccessfulTime is the completion time of the last succeeded run.
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty" yaml:"lastSuccessfulTime,omitempty"`
+	// Conditions has the Scheduled condition, False when runs were skipped.
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// +kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+// +kubebuilder:printcolumn:name="Suspend",type=boolean,JSONPath=`.spec.suspend`
+// +kubebuilder:printcolumn:name="To",type=string,JSONPath=`.spec.template.spec.to`
+// +kubebuilder:printcolumn:name="LastSchedule",type=date,JSONPath=`.status.lastScheduleTime`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type ImageBuilderSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageBuilderScheduleSpec   `json:"spec,omitempty"`
+	Status ImageBuilderScheduleStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ImageBuilderScheduleList contains a list of ImageBuilderSchedule
+type ImageBuilderScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageBuilderSchedule `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageBuilderSchedule{}, &ImageBuilderScheduleList{})
+}
+
+func (in *ImageBuilderSchedule) SuccessfulHistoryLimit() int {
+	if in.Spec.SuccessfulHistoryLimit != nil {
+		return int(*in.Spec.SuccessfulHistoryLimit)
+	}
+	return 3
+}
+
+func (in *ImageBuilderSchedule) FailedHistoryLimit() int {
+	if in.Spec.FailedHistoryLimit != nil {
+		return int(*in.Spec.FailedHistoryLimit)
+	}
+	return 1
+}
+
+func (in *ImageBuilderSchedule) ConcurrencyPolicy() ConcurrencyPolicy {
+	if in.Spec.ConcurrencyPolicy != "" {
+		return in.Spec.ConcurrencyPolicy
+	}
+	return ForbidConcurrent
+}
+
+// SetCondition adds or updates the condition of the given type, stamped with the current generation.
+func (in *ImageBuilderSchedule) SetCondition(conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&in.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: in.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
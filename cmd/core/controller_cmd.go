@@ -3,16 +3,27 @@ package core
 import (
 	"github.com/spf13/cobra"
 	"imagebuilder/pkg/controller"
+	ibwebhook "imagebuilder/pkg/webhook"
+	batchv1 "k8s.io/api/batch/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	"os"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"time"
 )
 
 type ControllerOptions struct {
-	MaxWorkNumber int
+	MaxWorkNumber           int
+	EnableWebhook           bool
+	WebhookPort             int
+	WebhookCertDir          string
+	TTLSecondsAfterFinished int32
+	FailedJobRetention      time.Duration
 }
 
 func NewControllerOptions() *ControllerOptions {
@@ -24,10 +35,24 @@ func NewControllerCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "controller",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			buildNamespaces := os.Getenv("imagebuild_namespace")
+			buildName := os.Getenv("imagebuild_name")
+			cacheOptions := cache.Options{}
+			if buildNamespaces != "" {
+				// builder jobs are always created next to the controller
+				cacheOptions.ByObject = map[client.Object]cache.ByObject{
+					&batchv1.Job{}: {Namespaces: map[string]cache.Config{buildNamespaces: {}}},
+				}
+			}
 			mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 				Scheme:         scheme,
 				LeaderElection: false,
 				Metrics:        metricsserver.Options{BindAddress: "0"},
+				Cache:          cacheOptions,
+				WebhookServer: webhook.NewServer(webhook.Options{
+					Port:    c.WebhookPort,
+					CertDir: c.WebhookCertDir,
+				}),
 			})
 			if err != nil {
 				klog.Fatalf("unable to create manager: %v", err)
@@ -38,8 +63,6 @@ func NewControllerCommand() *cobra.Command {
 				klog.Errorf("failed to start manager")
 				return err
 			}
-			buildNamespaces := os.Getenv("imagebuild_namespace")
-			buildName := os.Getenv("imagebuild_name")
 			klog.Infof("get controlelr pod resources %s/%s", buildName, buildNamespaces)
 			pod, err := clientSet.CoreV1().Pods(buildNamespaces).Get(cmd.Context(), buildName, metav1.GetOptions{})
 			if err != nil {
@@ -47,15 +70,35 @@ func NewControllerCommand() *cobra.Command {
 				//return err
 			}
 			if err = (&controller.ImageBuilderReconciler{
-				Client:     mgr.GetClient(),
-				Scheme:     mgr.GetScheme(),
-				ClientSet:  clientSet,
-				ManagerPod: pod,
-				MaxWorkNum: c.MaxWorkNumber,
+				Client:                         mgr.GetClient(),
+				Scheme:                         mgr.GetScheme(),
+				ClientSet:                      clientSet,
+				APIReader:                      mgr.GetAPIReader(),
+				ManagerPod:                     pod,
+				MaxWorkNum:                     c.MaxWorkNumber,
+				DefaultTTLSecondsAfterFinished: c.TTLSecondsAfterFinished,
+				FailedJobRetention:             c.FailedJobRetention,
 			}).SetupWithManager(mgr); err != nil {
 				klog.Fatalf("unable to create manager: %v", err)
 				return err
 			}
+			if err = (&controller.ImageBuilderScheduleReconciler{
+				Client: mgr.GetClient(),
+				Scheme: mgr.GetScheme(),
+			}).SetupWithManager(mgr); err != nil {
+				klog.Fatalf("unable to create manager: %v", err)
+				return err
+			}
+			if c.EnableWebhook {
+				if err = ibwebhook.SetupImageBuilderWebhookWithManager(mgr); err != nil {
+					klog.Fatalf("unable to create webhook: %v", err)
+					return err
+				}
+				if err = ibwebhook.SetupImageBuilderScheduleWebhookWithManager(mgr); err != nil {
+					klog.Fatalf("unable to create webhook: %v", err)
+					return err
+				}
+			}
 			klog.Info("starting manager")
 			if err = mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 				klog.Fatalf("problem running manager: %v", err)
@@ -70,4 +113,9 @@ func NewControllerCommand() *cobra.Command {
 
 func (c *ControllerOptions) addCommandFlag(cmd *cobra.Command) {
 	cmd.Flags().IntVarP(&c.MaxWorkNumber, "queue", "q", 10, "max work number")
+	cmd.Flags().Int32Var(&c.TTLSecondsAfterFinished, "ttl-seconds-after-finished", -1, "default ttlSecondsAfterFinished of ImageBuilders, negative keeps them forever")
+	cmd.Flags().DurationVar(&c.FailedJobRetention, "failed-job-retention", 24*time.Hour, "how long the job and pods of a failed build are kept")
+	cmd.Flags().BoolVar(&c.EnableWebhook, "enable-webhook", false, "serve the ImageBuilder admission webhooks")
+	cmd.Flags().IntVar(&c.WebhookPort, "webhook-port", 9443, "admission webhook port")
+	cmd.Flags().StringVar(&c.WebhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "directory of the webhook tls.crt and tls.key")
 }
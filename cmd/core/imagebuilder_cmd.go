@@ -25,5 +25,6 @@ func NewImageBuilderCommand() *cobra.Command {
 
 	builderCmd.AddCommand(NewControllerCommand())
 	builderCmd.AddCommand(NewJobCommand())
+	builderCmd.AddCommand(NewRecoverCommand())
 	return builderCmd
 }
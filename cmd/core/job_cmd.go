@@ -7,14 +7,20 @@ import (
 	dockerclient "github.com/docker/docker/client"
 	"github.com/spf13/cobra"
 	imagebuilderv1 "imagebuilder/api/v1"
+	"imagebuilder/pkg/constant"
 	"imagebuilder/pkg/core"
+	"imagebuilder/pkg/policy"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 	"path"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"strings"
+	"time"
 )
 
 type JobOptions struct {
@@ -67,35 +73,94 @@ func NewJobCommand() *cobra.Command {
 
 			if options.ContainerId == "" {
 				klog.Errorf("containerID is empty")
-				return err
+				return fmt.Errorf("containerID is empty")
+			}
+			if _, ok := builderAction.(*core.Docker); ok {
+				// fails before the container is paused and committed for nothing
+				if err = core.CheckDockerTLS(&imageBuilder.Spec); err != nil {
+					klog.Errorf("%s/%s: %v", options.Namespace, options.Name, err)
+					options.recordFailure(cmd.Context(), imagebuilderv1.FailureUnknown, err)
+					return err
+				}
+			}
+
+			// the runtime calls run with the deadline, the status updates must still pass after it expired
+			ctx := cmd.Context()
+			if imageBuilder.Spec.Timeout != nil {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, imageBuilder.Spec.Timeout.Duration)
+				defer cancel()
 			}
 
-			to := imageBuilder.Spec.To
-			err = builderAction.Commit(cmd.Context(), options.ContainerId, to)
+			to := imageBuilder.Spec.CommitReference()
+			retryPolicy := imageBuilder.Spec.RetryPolicy
+			options.updateState(cmd.Context(), constant.Committing)
+			commitOptions, err := options.commitOptions(cmd.Context(), imageBuilder)
+			if err == nil {
+				err = options.commitWithHooks(ctx, builderAction, imageBuilder.Spec.Commit, func() error {
+					if commitOptions.Pause {
+						// tells the controller to resume the container if this job dies during the commit
+						options.updateStatus(cmd.Context(), func(imageBuilder *imagebuilderv1.ImageBuilder) {
+							imageBuilder.SetCondition(constant.ConditionContainerPaused, metav1.ConditionTrue, constant.ReasonPausedForCommit,
+								fmt.Sprintf("container %s is paused while it is committed", options.ContainerId))
+						})
+					}
+					err := retryStep(ctx, retryPolicy, "commit", func() error {
+						return builderAction.Commit(ctx, options.ContainerId, to, commitOptions)
+					})
+					if commitOptions.Pause {
+						if resumeErr := options.resumeContainer(cmd.Context(), builderAction); resumeErr != nil && err == nil {
+							err = resumeErr
+						}
+					}
+					return err
+				})
+			}
+			options.updateCondition(cmd.Context(), constant.ConditionCommitted, constant.ReasonCommitSucceeded, constant.ReasonCommitFailed, err)
 			if err != nil {
 				klog.Errorf("containerd commit error: %v", err)
+				options.recordFailure(cmd.Context(), core.ClassifyError(err), err)
 				return err
 			}
 			klog.Infof("containerd commit success: %s", to)
 
-			switch imageBuilder.Spec.Operator {
-			case imagebuilderv1.Save:
-				tos := strings.Split(to, "/")
-				image := tos[len(tos)-1] + ".tar"
-				err = builderAction.Save(cmd.Context(), to, path.Join(imageBuilder.Spec.LocalHostPath.DefaultContainerPath(), image))
-				if err != nil {
-					klog.Errorf("containerd save error: %v", err)
-					return err
-				}
-				break
-			default:
-				err = builderAction.Push(cmd.Context(), to, imageBuilder.Spec.Username, imageBuilder.Spec.Password)
+			imageStatus, err := builderAction.Inspect(ctx, to)
+			size := int64(-1)
+			if err != nil {
+				// the image info is informational only, only a policy with maxImageSize fails the build for it
+				klog.Errorf("inspect image %s error: %v", to, err)
+				imageStatus = &imagebuilderv1.ImageStatus{Reference: to}
+			} else {
+				size = imageStatus.Size
+			}
+
+			policies, err := policy.List(cmd.Context(), r)
+			if err != nil {
+				return err
+			}
+			if err = policy.CheckImageSize(policies, size); err != nil {
+				klog.Errorf("%s/%s: %v", options.Namespace, options.Name, err)
+				options.updateStatus(cmd.Context(), func(imageBuilder *imagebuilderv1.ImageBuilder) {
+					for _, operation := range imageBuilder.Spec.OperationList() {
+						imageBuilder.SetCondition(operationCondition(operation), metav1.ConditionFalse, constant.ReasonPolicyViolation, err.Error())
+					}
+				})
+				options.recordFailure(cmd.Context(), imagebuilderv1.FailurePolicyViolation, err)
+				return err
+			}
+
+			// every operation works on the image committed above, the first failure ends the build
+			for _, operation := range imageBuilder.Spec.OperationList() {
+				options.updateOperation(cmd.Context(), operation, nil, true)
+				err = options.runOperation(ctx, cmd.Context(), builderAction, imageBuilder, operation, imageStatus)
+				options.updateOperation(cmd.Context(), operation, err, false)
 				if err != nil {
-					klog.Errorf("containerd push error: %v", err)
+					klog.Errorf("%s error: %v", operation, err)
+					options.recordFailure(cmd.Context(), core.ClassifyError(err), err)
 					return err
 				}
-
 			}
+			options.updateImage(cmd.Context(), imageStatus)
 
 			return nil
 
@@ -113,6 +178,370 @@ func (j *JobOptions) AddCommandFlag(cmd *cobra.Command) {
 	cmd.Flags().StringVar(&j.ContainerId, "container-id", "", "")
 }
 
+// updateStatus applies mutate to the latest ImageBuilder and writes its status back. The controller
+// updates the same status, so conflicts are retried. A failed update is only logged, it must not
+// fail the build itself.
+func (j *JobOptions) updateStatus(ctx context.Context, mutate func(imageBuilder *imagebuilderv1.ImageBuilder)) {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		imageBuilder := &imagebuilderv1.ImageBuilder{}
+		err := j.Client.Get(ctx, client.ObjectKey{Namespace: j.Namespace, Name: j.Name}, imageBuilder)
+		if err != nil {
+			return err
+		}
+		mutate(imageBuilder)
+		return j.Client.Status().Update(ctx, imageBuilder)
+	})
+	if err != nil {
+		klog.Errorf("update status of %s/%s error: %v", j.Namespace, j.Name, err)
+	}
+}
+
+func (j *JobOptions) updateState(ctx context.Context, state string) {
+	j.updateStatus(ctx, func(imageBuilder *imagebuilderv1.ImageBuilder) {
+		imageBuilder.Status.State = state
+	})
+}
+
+// updateCondition marks conditionType True with successReason when err is nil, False with failedReason otherwise.
+func (j *JobOptions) updateCondition(ctx context.Context, conditionType, successReason, failedReason string, err error) {
+	j.updateStatus(ctx, func(imageBuilder *imagebuilderv1.ImageBuilder) {
+		if err != nil {
+			imageBuilder.SetCondition(conditionType, metav1.ConditionFalse, failedReason, err.Error())
+			return
+		}
+		imageBuilder.SetCondition(conditionType, metav1.ConditionTrue, successReason, "")
+	})
+}
+
+func (j *JobOptions) updateImage(ctx context.Context, imageStatus *imagebuilderv1.ImageStatus) {
+	klog.Infof("image %s digest %s size %d", imageStatus.Reference, imageStatus.Digest, imageStatus.Size)
+	j.updateStatus(ctx, func(imageBuilder *imagebuilderv1.ImageBuilder) {
+		imageBuilder.Status.Image = imageStatus
+	})
+}
+
+// recordFailure reports the classified error of a failed build, the controller copies it
+// into the Ready condition once the job failed.
+func (j *JobOptions) recordFailure(ctx context.Context, reason imagebuilderv1.FailureReason, err error) {
+	j.updateStatus(ctx, func(imageBuilder *imagebuilderv1.ImageBuilder) {
+		imageBuilder.Status.FailureReason = reason
+		imageBuilder.Status.Reason = err.Error()
+	})
+}
+
+// retryStep runs step until it succeeds, fails with a reason the policy does not retry,
+// or used up its attempts.
+func retryStep(ctx context.Context, policy *imagebuilderv1.RetryPolicy, name string, step func() error) error {
+	backoff := policy.InitialBackoff()
+	for attempt := 1; ; attempt++ {
+		err := step()
+		if err == nil {
+			return nil
+		}
+		reason := core.ClassifyError(err)
+		if attempt >= policy.Attempts() || !policy.Retries(reason) {
+			return err
+		}
+		klog.Warningf("%s failed with %s, attempt %d/%d, retry in %s: %v", name, reason, attempt, policy.Attempts(), backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w, last error: %v", name, ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (j *JobOptions) commitOptions(ctx context.Context, imageBuilder *imagebuilderv1.ImageBuilder) (core.CommitOptions, error) {
+	opts := core.CommitOptions{
+		PodEnv: j.podEnv(ctx, imageBuilder.Spec.Namespace, imageBuilder.TargetPodName(), imageBuilder.Spec.ContainerName),
+	}
+	spec := imageBuilder.Spec.Commit
+	if spec == nil || !spec.DisableDefaultExcludePaths {
+		opts.ExcludePaths = append(opts.ExcludePaths, core.DefaultExcludePaths...)
+	}
+	if spec != nil {
+		opts.Changes = spec.Changes
+		opts.Author = spec.Author
+		opts.Message = spec.Message
+		opts.KeepEnv = spec.KeepEnv
+		opts.PreserveImageConfig = spec.PreserveImageConfig
+		opts.ExcludePaths = append(opts.ExcludePaths, spec.ExcludePaths...)
+		opts.Squash = spec.Squash
+	}
+	opts.Pause = spec.PauseContainer()
+	for _, addFile := range imageBuilder.Spec.AddFiles {
+		file, found, err := j.addFile(ctx, imageBuilder.Namespace, addFile)
+		if err != nil {
+			return opts, err
+		}
+		if found {
+			opts.AddFiles = append(opts.AddFiles, file)
+		}
+	}
+	return opts, nil
+}
+
+// resumeContainer resumes the container paused for the commit. The runtime resumes it without the
+// context of the build, which fails once the build timed out, the job deadline leaves room for
+// core.ContainerResumeTimeout. ContainerPaused stays True when the container can not be resumed,
+// the controller recovers it after the job failed.
+func (j *JobOptions) resumeContainer(ctx context.Context, action core.ImageBuilderAction) error {
+	resumeCtx, cancel := context.WithTimeout(context.Background(), core.ContainerResumeTimeout)
+	defer cancel()
+	resumed, err := action.Resume(resumeCtx, j.ContainerId)
+	if err != nil {
+		return fmt.Errorf("resume container %s: %w", j.ContainerId, err)
+	}
+	if resumed {
+		klog.Warningf("container %s was still paused after the commit, resumed it", j.ContainerId)
+	}
+	j.updateStatus(ctx, func(imageBuilder *imagebuilderv1.ImageBuilder) {
+		imageBuilder.SetCondition(constant.ConditionContainerPaused, metav1.ConditionFalse, constant.ReasonContainerResumed, "")
+	})
+	return nil
+}
+
+// commitWithHooks runs commit between the pre and post commit hooks of spec. The post hook runs
+// whenever the pre hook was started, so a writer stopped by the pre hook is restarted even if the
+// commit failed.
+func (j *JobOptions) commitWithHooks(ctx context.Context, action core.ImageBuilderAction, spec *imagebuilderv1.CommitSpec, commit func() error) error {
+	if spec == nil {
+		return commit()
+	}
+	err := j.runHook(ctx, action, "preCommitHook", spec.PreCommitHook, 0)
+	if err == nil {
+		err = commit()
+	}
+	// the post hook must also run when the build timed out, the job deadline leaves room for it
+	if postErr := j.runHook(context.Background(), action, "postCommitHook", spec.PostCommitHook, core.DefaultPostCommitHookTimeout); postErr != nil {
+		if err == nil {
+			return postErr
+		}
+		klog.Errorf("%v", postErr)
+	}
+	return err
+}
+
+// runHook executes hook in the container, limited by the timeout of the hook or else by
+// defaultTimeout if it is not 0.
+func (j *JobOptions) runHook(ctx context.Context, action core.ImageBuilderAction, name string, hook *imagebuilderv1.CommitHook, defaultTimeout time.Duration) error {
+	if hook == nil {
+		return nil
+	}
+	timeout := defaultTimeout
+	if hook.Timeout != nil {
+		timeout = hook.Timeout.Duration
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	klog.Infof("run %s %q in container %s", name, hook.Command, j.ContainerId)
+	output, err := action.Exec(ctx, j.ContainerId, hook.Command)
+	if output != "" {
+		klog.Infof("%s output:\n%s", name, output)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// addFile reads the ConfigMap or Secret key of addFile. A missing optional key is not found.
+func (j *JobOptions) addFile(ctx context.Context, namespace string, addFile imagebuilderv1.AddFile) (core.File, bool, error) {
+	file := core.File{Path: addFile.Path, Mode: 0644}
+	if addFile.Mode != nil {
+		file.Mode = int64(*addFile.Mode)
+	}
+	data, found, err := j.keyRefData(ctx, namespace, addFile.ConfigMapKeyRef, addFile.SecretKeyRef)
+	if err != nil {
+		return file, false, fmt.Errorf("addFile %s: %w", addFile.Path, err)
+	}
+	if !found {
+		klog.Warningf("addFile %s: optional key not found, skipped", addFile.Path)
+		return file, false, nil
+	}
+	file.Data = data
+	return file, true, nil
+}
+
+// keyRefData reads the key selected by configMapKeyRef or secretKeyRef. A missing optional key
+// is not found.
+func (j *JobOptions) keyRefData(ctx context.Context, namespace string, configMapKeyRef *corev1.ConfigMapKeySelector, secretKeyRef *corev1.SecretKeySelector) ([]byte, bool, error) {
+	var name, key string
+	var optional *bool
+	var data []byte
+	var found bool
+	var err error
+	switch {
+	case configMapKeyRef != nil:
+		name, key, optional = configMapKeyRef.Name, configMapKeyRef.Key, configMapKeyRef.Optional
+		configMap := &corev1.ConfigMap{}
+		err = j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, configMap)
+		if value, ok := configMap.Data[key]; ok {
+			data, found = []byte(value), true
+		} else if binaryData, ok := configMap.BinaryData[key]; ok {
+			data, found = binaryData, true
+		}
+	case secretKeyRef != nil:
+		name, key, optional = secretKeyRef.Name, secretKeyRef.Key, secretKeyRef.Optional
+		secret := &corev1.Secret{}
+		err = j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, secret)
+		data, found = secret.Data[key]
+	default:
+		return nil, false, fmt.Errorf("neither configMapKeyRef nor secretKeyRef is set")
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, false, err
+	}
+	if !found && (optional == nil || !*optional) {
+		return nil, false, fmt.Errorf("key %s of %s/%s not found", key, namespace, name)
+	}
+	return data, found, nil
+}
+
+// registryTLS reads the CA bundle and the client certificate of tlsSpec. A missing optional CA
+// leaves the system CAs only.
+func (j *JobOptions) registryTLS(ctx context.Context, namespace string, tlsSpec *imagebuilderv1.RegistryTLS) (*core.RegistryTLS, error) {
+	if tlsSpec == nil {
+		return nil, nil
+	}
+	registryTLS := &core.RegistryTLS{PlainHTTP: tlsSpec.PlainHTTP, InsecureSkipVerify: tlsSpec.InsecureSkipVerify}
+	if tlsSpec.CA != nil {
+		ca, _, err := j.keyRefData(ctx, namespace, tlsSpec.CA.ConfigMapKeyRef, tlsSpec.CA.SecretKeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("tls.ca: %w", err)
+		}
+		registryTLS.CA = ca
+	}
+	if ref := tlsSpec.ClientCertSecretRef; ref != nil {
+		secret := &corev1.Secret{}
+		err := j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, secret)
+		if err != nil {
+			return nil, fmt.Errorf("get client certificate secret %s/%s: %w", namespace, ref.Name, err)
+		}
+		registryTLS.ClientCert, registryTLS.ClientKey = secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+		if len(registryTLS.ClientCert) == 0 || len(registryTLS.ClientKey) == 0 {
+			return nil, fmt.Errorf("client certificate secret %s/%s has no %s and %s", namespace, ref.Name, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		}
+	}
+	return registryTLS, nil
+}
+
+// podEnv returns the names of the variables the pod spec sets in the container. It is only used
+// when the env of the original image is unknown, so errors are logged and skipped.
+func (j *JobOptions) podEnv(ctx context.Context, namespace, podName, containerName string) []string {
+	pod := &corev1.Pod{}
+	err := j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: podName}, pod)
+	if err != nil {
+		klog.Warningf("get pod %s/%s error: %v", namespace, podName, err)
+		return nil
+	}
+	var names []string
+	for _, c := range pod.Spec.Containers {
+		if c.Name != containerName {
+			continue
+		}
+		for _, env := range c.Env {
+			names = append(names, env.Name)
+		}
+		for _, source := range c.EnvFrom {
+			var keys []string
+			err = nil
+			switch {
+			case source.SecretRef != nil:
+				secret := &corev1.Secret{}
+				err = j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: source.SecretRef.Name}, secret)
+				for key := range secret.Data {
+					keys = append(keys, key)
+				}
+			case source.ConfigMapRef != nil:
+				configMap := &corev1.ConfigMap{}
+				err = j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: source.ConfigMapRef.Name}, configMap)
+				for key := range configMap.Data {
+					keys = append(keys, key)
+				}
+			}
+			if err != nil {
+				klog.Warningf("get env source of pod %s/%s error: %v", namespace, podName, err)
+				continue
+			}
+			for _, key := range keys {
+				names = append(names, source.Prefix+key)
+			}
+		}
+	}
+	return names
+}
+
+// runOperation runs operation on the committed image and reports it in its condition.
+func (j *JobOptions) runOperation(ctx, statusCtx context.Context, action core.ImageBuilderAction, imageBuilder *imagebuilderv1.ImageBuilder, operation imagebuilderv1.OperatorType, imageStatus *imagebuilderv1.ImageStatus) error {
+	to := imageBuilder.Spec.CommitReference()
+	tos := strings.Split(to, "/")
+	outputDir := imageBuilder.Spec.LocalHostPath.DefaultContainerPath()
+	retryPolicy := imageBuilder.Spec.RetryPolicy
+
+	var err error
+	switch operation {
+	case imagebuilderv1.Save:
+		j.updateState(statusCtx, constant.Saving)
+		err = retryStep(ctx, retryPolicy, "save", func() error {
+			return action.Save(ctx, to, path.Join(outputDir, tos[len(tos)-1]+".tar"))
+		})
+		j.updateCondition(statusCtx, constant.ConditionSaved, constant.ReasonSaveSucceeded, constant.ReasonSaveFailed, err)
+	case imagebuilderv1.ExportRootfs:
+		j.updateState(statusCtx, constant.Exporting)
+		err = retryStep(ctx, retryPolicy, "exportRootfs", func() error {
+			return action.ExportRootfs(ctx, to, path.Join(outputDir, tos[len(tos)-1]+"-rootfs.tar"))
+		})
+		j.updateCondition(statusCtx, constant.ConditionRootfsExported, constant.ReasonExportSucceeded, constant.ReasonExportFailed, err)
+	default:
+		j.updateState(statusCtx, constant.Pushing)
+		err = j.pushDestinations(ctx, statusCtx, action, imageBuilder, imageStatus)
+		j.updateCondition(statusCtx, constant.ConditionPushed, constant.ReasonPushSucceeded, constant.ReasonPushFailed, err)
+	}
+	return err
+}
+
+// updateOperation reports operation in status.operations as Running when started is set, as
+// Succeeded or Failed by err otherwise.
+func (j *JobOptions) updateOperation(ctx context.Context, operation imagebuilderv1.OperatorType, err error, started bool) {
+	j.updateStatus(ctx, func(imageBuilder *imagebuilderv1.ImageBuilder) {
+		var status *imagebuilderv1.OperationStatus
+		for i := range imageBuilder.Status.Operations {
+			if imageBuilder.Status.Operations[i].Operation == operation {
+				status = &imageBuilder.Status.Operations[i]
+			}
+		}
+		if status == nil {
+			imageBuilder.Status.Operations = append(imageBuilder.Status.Operations, imagebuilderv1.OperationStatus{Operation: operation})
+			status = &imageBuilder.Status.Operations[len(imageBuilder.Status.Operations)-1]
+		}
+		now := metav1.Now()
+		switch {
+		case started:
+			*status = imagebuilderv1.OperationStatus{Operation: operation, State: constant.Running, StartTime: &now}
+		case err != nil:
+			status.State, status.Message, status.CompletionTime = constant.Failed, err.Error(), &now
+		default:
+			status.State, status.CompletionTime = constant.Succeeded, &now
+		}
+	})
+}
+
+// operationCondition is the condition reporting the result of operator.
+func operationCondition(operator imagebuilderv1.OperatorType) string {
+	switch operator {
+	case imagebuilderv1.Save:
+		return constant.ConditionSaved
+	case imagebuilderv1.ExportRootfs:
+		return constant.ConditionRootfsExported
+	}
+	return constant.ConditionPushed
+}
+
 func (j *JobOptions) validate() error {
 	if j.Name == "" {
 		return fmt.Errorf("name is empty")
@@ -120,6 +549,148 @@ func (j *JobOptions) validate() error {
 	return nil
 }
 
+// pushDestinations pushes the committed image to every destination, the ones after a failed
+// push are still tried and the first error is returned. The results are reported in
+// status.destinations, statusCtx is used for the status updates.
+func (j *JobOptions) pushDestinations(ctx, statusCtx context.Context, action core.ImageBuilderAction, imageBuilder *imagebuilderv1.ImageBuilder, imageStatus *imagebuilderv1.ImageStatus) error {
+	var results []imagebuilderv1.DestinationStatus
+	var firstErr error
+	pushed := false
+	for _, destination := range imageBuilder.Spec.PushDestinations() {
+		digest, err := j.pushDestination(ctx, action, imageBuilder, destination)
+		result := imagebuilderv1.DestinationStatus{To: destination.To, State: constant.Succeeded, Digest: digest}
+		if err != nil {
+			klog.Errorf("push %s error: %v", destination.To, err)
+			result.State, result.Message = constant.Failed, err.Error()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("push %s: %w", destination.To, err)
+			}
+		} else if digest != "" && !pushed {
+			// the manifest is the same in every registry
+			imageStatus.Digest, pushed = digest, true
+		}
+		results = append(results, result)
+		j.updateStatus(statusCtx, func(imageBuilder *imagebuilderv1.ImageBuilder) {
+			imageBuilder.Status.Destinations = results
+		})
+	}
+	return firstErr
+}
+
+// pushDestination tags the committed image for destination and pushes it. Only the push is
+// retried, the committed image is reused.
+func (j *JobOptions) pushDestination(ctx context.Context, action core.ImageBuilderAction, imageBuilder *imagebuilderv1.ImageBuilder, destination imagebuilderv1.Destination) (string, error) {
+	if committed := imageBuilder.Spec.CommitReference(); destination.To != committed {
+		if err := action.Tag(ctx, committed, destination.To); err != nil {
+			return "", fmt.Errorf("tag %s: %w", committed, err)
+		}
+	}
+	username, password, err := j.registryCredentials(ctx, imageBuilder, destination)
+	if err != nil {
+		return "", err
+	}
+	registryTLS, err := j.registryTLS(ctx, imageBuilder.Namespace, destination.TLS)
+	if err != nil {
+		return "", err
+	}
+	pushOptions := core.PushOptions{Username: username, Password: password, TLS: registryTLS}
+	var digest string
+	err = retryStep(ctx, imageBuilder.Spec.RetryPolicy, "push "+destination.To, func() error {
+		digest, err = action.Push(ctx, destination.To, pushOptions)
+		return err
+	})
+	return digest, err
+}
+
+// registryCredentials returns the credentials used to push destination. The secret referenced by
+// the destination wins over the deprecated plaintext username and password of spec.to, which
+// in turn win over the pull secrets of the source pod.
+func (j *JobOptions) registryCredentials(ctx context.Context, imageBuilder *imagebuilderv1.ImageBuilder, destination imagebuilderv1.Destination) (string, string, error) {
+	host, err := core.RegistryHost(destination.To)
+	if err != nil {
+		return "", "", err
+	}
+
+	secretRef := destination.CredentialsSecretRef
+	if secretRef != nil && secretRef.Name != "" {
+		return j.secretCredentials(ctx, imageBuilder.Namespace, secretRef.Name, host)
+	}
+	var username, password string
+	if len(imageBuilder.Spec.Destinations) == 0 {
+		username, password = imageBuilder.Spec.Username, imageBuilder.Spec.Password
+	}
+	if username != "" || !imageBuilder.Spec.UsePodPullSecrets {
+		return username, password, nil
+	}
+	if imageBuilder.Spec.Namespace != imageBuilder.Namespace {
+		return "", "", fmt.Errorf("usePodPullSecrets requires the target pod in namespace %s, not %s", imageBuilder.Namespace, imageBuilder.Spec.Namespace)
+	}
+	return j.podPullSecretCredentials(ctx, imageBuilder.Spec.Namespace, imageBuilder.TargetPodName(), host)
+}
+
+func (j *JobOptions) secretCredentials(ctx context.Context, namespace, name, host string) (string, string, error) {
+	secret := &corev1.Secret{}
+	err := j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, secret)
+	if err != nil {
+		return "", "", fmt.Errorf("get credentials secret %s/%s: %w", namespace, name, err)
+	}
+	username, password, found, err := core.CredentialsFromSecret(secret, host)
+	if err != nil {
+		return "", "", err
+	}
+	if !found {
+		return "", "", fmt.Errorf("credentials secret %s/%s has no entry for registry %s", namespace, name, host)
+	}
+	klog.Infof("use credentials secret %s/%s for registry %s", namespace, name, host)
+	return username, password, nil
+}
+
+// podPullSecretCredentials looks up host in the imagePullSecrets of the pod and of its ServiceAccount.
+// No match is not an error, the push is then attempted anonymously.
+func (j *JobOptions) podPullSecretCredentials(ctx context.Context, namespace, podName, host string) (string, string, error) {
+	pod := &corev1.Pod{}
+	err := j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: podName}, pod)
+	if err != nil {
+		return "", "", fmt.Errorf("get pod %s/%s: %w", namespace, podName, err)
+	}
+	pullSecrets := pod.Spec.ImagePullSecrets
+
+	saName := pod.Spec.ServiceAccountName
+	if saName == "" {
+		saName = "default"
+	}
+	sa := &corev1.ServiceAccount{}
+	err = j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: saName}, sa)
+	if err != nil {
+		klog.Warningf("get serviceaccount %s/%s error: %v", namespace, saName, err)
+	} else {
+		pullSecrets = append(pullSecrets, sa.ImagePullSecrets...)
+	}
+
+	for _, ref := range pullSecrets {
+		secret := &corev1.Secret{}
+		err = j.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, secret)
+		if err != nil {
+			klog.Warningf("get pull secret %s/%s error: %v", namespace, ref.Name, err)
+			continue
+		}
+		if secret.Type != corev1.SecretTypeDockerConfigJson && secret.Type != corev1.SecretTypeDockercfg {
+			continue
+		}
+		username, password, found, err := core.CredentialsFromSecret(secret, host)
+		if err != nil {
+			klog.Warningf("pull secret %s/%s: %v", namespace, ref.Name, err)
+			continue
+		}
+		if found {
+			klog.Infof("use pull secret %s/%s of pod %s for registry %s", namespace, ref.Name, podName, host)
+			return username, password, nil
+		}
+	}
+	klog.Warningf("no pull secret of pod %s/%s matches registry %s, push anonymously", namespace, podName, host)
+	return "", "", nil
+}
+
 func (j *JobOptions) initMontSock(ctx context.Context, nodeName string) (core.ImageBuilderAction, error) {
 	node := &corev1.Node{}
 	err := j.Client.Get(ctx, client.ObjectKey{Name: nodeName}, node)
@@ -128,7 +699,7 @@ func (j *JobOptions) initMontSock(ctx context.Context, nodeName string) (core.Im
 		klog.Fatal(err)
 		return nil, err
 	}
-	containerRuntime := strings.Split(node.Status.NodeInfo.ContainerRuntimeVersion, "://")[0]
+	containerRuntime := core.ContainerRuntime(node)
 	switch containerRuntime {
 	case "docker":
 		cli, err := dockerclient.NewClientWithOpts(dockerclient.WithHost("unix:///var/run/docker.sock"))
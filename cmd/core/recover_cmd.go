@@ -0,0 +1,84 @@
+package core
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	imagebuilderv1 "imagebuilder/api/v1"
+	"imagebuilder/pkg/constant"
+	"imagebuilder/pkg/core"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// NewRecoverCommand resumes the container of a builder job that terminated during the commit.
+func NewRecoverCommand() *cobra.Command {
+	options := newJobOptions()
+	recoverCmd := &cobra.Command{
+		Use: "recover",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.validate(); err != nil {
+				return err
+			}
+			if options.ContainerId == "" {
+				return fmt.Errorf("containerID is empty")
+			}
+			clientConfig, err := config.GetConfig()
+			if err != nil {
+				klog.Error(err, "unable to get kubeconfig")
+				clientConfig, err = rest.InClusterConfig()
+				if err != nil {
+					klog.Error(err, "unable to get InClusterConfig")
+					return err
+				}
+			}
+			r, err := client.New(clientConfig, client.Options{
+				Scheme: scheme,
+			})
+			if err != nil {
+				return err
+			}
+			options.Client = r
+			imageBuilder := &imagebuilderv1.ImageBuilder{}
+			err = r.Get(cmd.Context(), client.ObjectKey{Namespace: options.Namespace, Name: options.Name}, imageBuilder)
+			if err != nil {
+				return err
+			}
+
+			builderAction, err := options.initMontSock(cmd.Context(), imageBuilder.Status.Node)
+			if err != nil {
+				klog.Errorf("init mount sock error:%s", err)
+				return err
+			}
+
+			resumed, err := builderAction.Resume(cmd.Context(), options.ContainerId)
+			if err != nil && core.ClassifyError(err) == imagebuilderv1.FailureContainerNotFound {
+				// a deleted container is not paused anymore
+				klog.Warningf("container %s not found: %v", options.ContainerId, err)
+				err = nil
+			}
+			if err != nil {
+				// the job is retried, the controller reports the failure once it gave up
+				klog.Errorf("resume container %s error: %v", options.ContainerId, err)
+				return err
+			}
+
+			reason, message := constant.ReasonContainerRunning, fmt.Sprintf("container %s was not paused", options.ContainerId)
+			if resumed {
+				reason, message = constant.ReasonContainerResumed, fmt.Sprintf("container %s was paused and has been resumed", options.ContainerId)
+			}
+			klog.Info(message)
+			options.updateStatus(cmd.Context(), func(imageBuilder *imagebuilderv1.ImageBuilder) {
+				imageBuilder.SetCondition(constant.ConditionContainerPaused, metav1.ConditionFalse, reason, message)
+				imageBuilder.SetCondition(constant.ConditionContainerRecovered, metav1.ConditionTrue, reason, message)
+			})
+			return nil
+		},
+	}
+
+	options.AddCommandFlag(recoverCmd)
+
+	return recoverCmd
+}
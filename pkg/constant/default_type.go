@@ -1,7 +1,68 @@
 package constant
 
+// phases reported in ImageBuilderStatus.State
 const (
-	Creating  string = "Creating"
+	Creating   string = "Creating"
+	Committing string = "Committing"
+	Pushing    string = "Pushing"
+	Saving     string = "Saving"
+	Exporting  string = "Exporting"
+	// Running is the state of a started operation.
+	Running   string = "Running"
 	Failed    string = "Failed"
 	Succeeded string = "Succeeded"
 )
+
+// condition types reported in ImageBuilderStatus.Conditions
+const (
+	ConditionScheduled      string = "Scheduled"
+	ConditionCommitted      string = "Committed"
+	ConditionPushed         string = "Pushed"
+	ConditionSaved          string = "Saved"
+	ConditionRootfsExported string = "RootfsExported"
+	ConditionReady          string = "Ready"
+	// ConditionContainerPaused is True while the job commits with a paused container.
+	ConditionContainerPaused string = "ContainerPaused"
+	// ConditionContainerRecovered reports the recovery of a container left paused by a dead job.
+	ConditionContainerRecovered string = "ContainerRecovered"
+)
+
+// condition reasons
+const (
+	ReasonInvalidSpec        string = "InvalidSpec"
+	ReasonPodNotFound        string = "PodNotFound"
+	ReasonContainerNotFound  string = "ContainerNotFound"
+	ReasonPolicyViolation    string = "PolicyViolation"
+	ReasonJobCreated         string = "JobCreated"
+	ReasonJobSucceeded       string = "JobSucceeded"
+	ReasonJobFailed          string = "JobFailed"
+	ReasonCommitSucceeded    string = "CommitSucceeded"
+	ReasonCommitFailed       string = "CommitFailed"
+	ReasonPushSucceeded      string = "PushSucceeded"
+	ReasonPushFailed         string = "PushFailed"
+	ReasonSaveSucceeded      string = "SaveSucceeded"
+	ReasonSaveFailed         string = "SaveFailed"
+	ReasonExportSucceeded    string = "ExportSucceeded"
+	ReasonExportFailed       string = "ExportFailed"
+	ReasonPausedForCommit    string = "PausedForCommit"
+	ReasonContainerResumed   string = "ContainerResumed"
+	ReasonContainerRunning   string = "ContainerRunning"
+	ReasonRecoveryJobCreated string = "RecoveryJobCreated"
+	ReasonRecoveryFailed     string = "RecoveryFailed"
+	// reasons of the Scheduled condition of an ImageBuilderSchedule
+	ReasonRunCreated    string = "RunCreated"
+	ReasonRunRejected   string = "RunRejected"
+	ReasonMissedTooMany string = "MissedTooMany"
+
+	// JobReasonDeadlineExceeded is the reason of the Failed condition of a job that ran into activeDeadlineSeconds.
+	JobReasonDeadlineExceeded string = "DeadlineExceeded"
+)
+
+const (
+	LabelImageBuilderName      string = "imagebuilder.ai.qingcloud.com/name"
+	LabelImageBuilderNamespace string = "imagebuilder.ai.qingcloud.com/namespace"
+	LabelSchedule              string = "imagebuilder.ai.qingcloud.com/schedule"
+	AnnotationScheduledTime    string = "imagebuilder.ai.qingcloud.com/scheduled-time"
+	// FinalizerContainerRecovery keeps a deleted ImageBuilder until a container paused by its job is resumed.
+	FinalizerContainerRecovery string = "imagebuilder.ai.qingcloud.com/container-recovery"
+)
@@ -18,29 +18,45 @@ package controller
 
 import (
 	"context"
+	"fmt"
 	imagebuilderv1 "imagebuilder/api/v1"
 	"imagebuilder/pkg/constant"
 	"imagebuilder/pkg/core"
+	"imagebuilder/pkg/policy"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"strings"
 	"time"
 )
 
+const jobStatusRequeueInterval = 30 * time.Second
+
 type ImageBuilderReconciler struct {
 	client.Client
-	Scheme     *runtime.Scheme
-	ClientSet  *kubernetes.Clientset
+	Scheme    *runtime.Scheme
+	ClientSet *kubernetes.Clientset
+	// APIReader reads workloads and pods uncached
+	APIReader  client.Reader
 	ManagerPod *corev1.Pod
 	MaxWorkNum int
+	// DefaultTTLSecondsAfterFinished applies to ImageBuilders without spec.ttlSecondsAfterFinished,
+	// a negative value keeps them forever.
+	DefaultTTLSecondsAfterFinished int32
+	// FailedJobRetention is how long the job and pods of a failed build are kept for debugging.
+	FailedJobRetention time.Duration
 }
 
 func (r *ImageBuilderReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -48,45 +64,41 @@ func (r *ImageBuilderReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	err := r.Client.Get(ctx, req.NamespacedName, builder)
 	if err != nil {
 		if client.IgnoreNotFound(err) == nil {
-			return ctrl.Result{}, nil
+			return ctrl.Result{}, r.deleteOrphanJob(ctx, req.NamespacedName)
 		}
 		return ctrl.Result{}, err
 	}
 
 	if builder.DeletionTimestamp != nil {
 		klog.Warningf("%s cr deleting", builder.Name)
-		return ctrl.Result{}, nil
+		return r.finalize(ctx, builder)
 	}
 
-	if builder.Spec.PodName == "" {
-		klog.Errorf("cr podName is empty")
-		builder.Status.State = constant.Failed
-		builder.Status.Reason = "cr podName is empty"
-		err = r.Status().Update(ctx, builder)
+	if builder.Status.State == constant.Succeeded || builder.Status.State == constant.Failed {
+		return r.cleanupFinished(ctx, builder)
+	}
+
+	if builder.Spec.PodName == "" && builder.Spec.TargetRef == nil && builder.Spec.Selector == nil {
+		klog.Errorf("cr target pod is empty")
+		err = r.updateStatusFailed(ctx, builder, constant.ReasonInvalidSpec, "one of podName, targetRef or selector is required")
 		if err != nil {
 			klog.Errorf("update builder status error err:%s", err)
 			return ctrl.Result{}, err
 		}
 		return ctrl.Result{}, nil
 	}
-	if builder.Status.State == constant.Succeeded || builder.Status.State == constant.Failed {
-		if builder.Status.State == constant.Succeeded {
-			background := metav1.DeletePropagationBackground
-			err = r.ClientSet.BatchV1().Jobs(r.ManagerPod.Namespace).Delete(ctx, builder.Name, metav1.DeleteOptions{PropagationPolicy: &background})
-			if err != nil && !errors.IsNotFound(err) {
-				klog.Error("delete job error\n", err, "name:", builder.Name, "namespace:", r.ManagerPod.Namespace)
-			}
-		}
-		return ctrl.Result{}, nil
-	}
 
-	klog.Infof("get pod %s/%s", builder.Spec.Namespace, builder.Spec.PodName)
-	pod, err := r.ClientSet.CoreV1().Pods(builder.Spec.Namespace).Get(ctx, builder.Spec.PodName, metav1.GetOptions{})
+	// the pod is resolved once, later reconciles stick to the pod recorded in status
+	var pod *corev1.Pod
+	if builder.Status.PodName != "" {
+		klog.Infof("get pod %s/%s", builder.Spec.Namespace, builder.Status.PodName)
+		pod, err = r.ClientSet.CoreV1().Pods(builder.Spec.Namespace).Get(ctx, builder.Status.PodName, metav1.GetOptions{})
+	} else {
+		pod, err = core.ResolveTargetPod(ctx, r.APIReader, &builder.Spec)
+	}
 	if err != nil {
-		klog.Errorf("get pod: %s/%s error: %v", builder.Spec.Namespace, builder.Spec.PodName, err)
-		builder.Status.State = constant.Failed
-		builder.Status.Node = pod.Spec.NodeName
-		err = r.Status().Update(ctx, builder)
+		klog.Errorf("get pod of %s/%s error: %v", builder.Namespace, builder.Name, err)
+		err = r.updateStatusFailed(ctx, builder, constant.ReasonPodNotFound, err.Error())
 		if err != nil {
 			klog.Errorf("update status error: %v", err)
 			return ctrl.Result{}, err
@@ -96,8 +108,32 @@ func (r *ImageBuilderReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	}
 
 	if builder.Status.State == "" {
+		policies, err := policy.List(ctx, r.Client)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err = policy.CheckSpec(policies, builder, pod); err != nil {
+			klog.Errorf("%s/%s: %v", builder.Namespace, builder.Name, err)
+			return ctrl.Result{}, r.updateStatusFailed(ctx, builder, constant.ReasonPolicyViolation, err.Error())
+		}
+		node := &corev1.Node{}
+		if err = r.APIReader.Get(ctx, client.ObjectKey{Name: pod.Spec.NodeName}, node); err != nil {
+			return ctrl.Result{}, err
+		}
+		if core.ContainerRuntime(node) == "docker" {
+			// the runtime is known once the pod is, the job checks it again before the commit
+			if err = core.CheckDockerTLS(&builder.Spec); err != nil {
+				klog.Errorf("%s/%s: %v", builder.Namespace, builder.Name, err)
+				return ctrl.Result{}, r.updateStatusFailed(ctx, builder, constant.ReasonInvalidSpec, err.Error())
+			}
+		}
+
+		now := metav1.Now()
 		builder.Status.State = constant.Creating
 		builder.Status.Node = pod.Spec.NodeName
+		builder.Status.PodName = pod.Name
+		builder.Status.StartTime = &now
+		builder.Status.ObservedGeneration = builder.Generation
 		err = r.Status().Update(ctx, builder)
 		if err != nil {
 			klog.Errorf("update status error: %v", err)
@@ -106,6 +142,89 @@ func (r *ImageBuilderReconciler) Reconcile(ctx context.Context, req ctrl.Request
 		return ctrl.Result{}, nil
 	}
 
+	m := r.jobOptions(builder, pod)
+	if m.ContainerId == "" {
+		message := fmt.Sprintf("container %q of pod %s/%s not found or not started", builder.Spec.ContainerName, builder.Spec.Namespace, pod.Name)
+		klog.Error(message)
+		return ctrl.Result{}, r.updateStatusFailed(ctx, builder, constant.ReasonContainerNotFound, message)
+	}
+
+	jobName := core.JobName(m.Namespace, m.Name)
+	klog.Infof("check for running tasks.  %s/%s", jobName, m.JobNamespace)
+	j := &batchv1.Job{}
+	err = r.Get(ctx, client.ObjectKey{Namespace: m.JobNamespace, Name: jobName}, j)
+	if err == nil && !core.OwnsJob(j, m.Namespace, m.Name) {
+		return ctrl.Result{}, fmt.Errorf("job %s/%s does not belong to %s/%s", m.JobNamespace, jobName, m.Namespace, m.Name)
+	}
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		if meta.IsStatusConditionTrue(builder.Status.Conditions, constant.ConditionContainerPaused) {
+			// the job was deleted during the commit, the build is not run again on a paused container
+			message := fmt.Sprintf("job %s/%s was deleted while container %s was paused", m.JobNamespace, jobName, m.ContainerId)
+			done, err := r.recoverContainer(ctx, builder, m, message)
+			if err != nil || !done {
+				return ctrl.Result{RequeueAfter: jobStatusRequeueInterval}, err
+			}
+			return ctrl.Result{}, r.updateStatusFailed(ctx, builder, constant.ReasonJobFailed, message)
+		}
+		if controllerutil.AddFinalizer(builder, constant.FinalizerContainerRecovery) {
+			// the job may pause the container, the ImageBuilder must outlive it to resume the container
+			if err = r.Update(ctx, builder); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		err = r.Create(ctx, core.JobTemplate(m))
+		if err != nil && !errors.IsAlreadyExists(err) {
+			klog.Errorf("failed to create builder job. err:%s", err)
+			return ctrl.Result{}, err
+		}
+		builder.SetCondition(constant.ConditionScheduled, metav1.ConditionTrue, constant.ReasonJobCreated,
+			fmt.Sprintf("job %s/%s created on node %s", m.JobNamespace, jobName, m.NodeName))
+		err = r.Status().Update(ctx, builder)
+		if err != nil {
+			klog.Errorf("update status error: %v", err)
+			return ctrl.Result{}, err
+		}
+		// the job watch brings us back on status changes, the requeue only guards against missed events
+		return ctrl.Result{RequeueAfter: jobStatusRequeueInterval}, nil
+	}
+
+	for _, condition := range j.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			klog.Infof("save images complete for %s/%s", jobName, m.JobNamespace)
+			return ctrl.Result{}, r.updateStatusSuccess(ctx, builder)
+		case batchv1.JobFailed:
+			if meta.IsStatusConditionTrue(builder.Status.Conditions, constant.ConditionContainerPaused) {
+				done, err := r.recoverContainer(ctx, builder, m, condition.Message)
+				if err != nil || !done {
+					return ctrl.Result{RequeueAfter: jobStatusRequeueInterval}, err
+				}
+			}
+			if builder.Status.FailureReason != "" {
+				// the job classified its error, it is more useful than the job condition
+				return ctrl.Result{}, r.updateStatusFailed(ctx, builder, string(builder.Status.FailureReason), builder.Status.Reason)
+			}
+			if condition.Reason == constant.JobReasonDeadlineExceeded {
+				// the job was killed before it could report the timeout itself
+				return ctrl.Result{}, r.updateStatusFailed(ctx, builder, string(imagebuilderv1.FailureTimeout), condition.Message)
+			}
+			return ctrl.Result{}, r.updateStatusFailed(ctx, builder, constant.ReasonJobFailed, condition.Message)
+		}
+	}
+
+	klog.Infof("get job status for '%s/%s'. createtime:%s", jobName, m.JobNamespace, j.CreationTimestamp.String())
+	return ctrl.Result{RequeueAfter: jobStatusRequeueInterval}, nil
+}
+
+// jobOptions returns the options of the jobs of builder for the container of pod, ContainerId
+// is empty if the container is not found or not started.
+func (r *ImageBuilderReconciler) jobOptions(builder *imagebuilderv1.ImageBuilder, pod *corev1.Pod) core.JobOptions {
 	m := core.JobOptions{
 		Namespace:     builder.Namespace,
 		Name:          builder.Name,
@@ -114,71 +233,237 @@ func (r *ImageBuilderReconciler) Reconcile(ctx context.Context, req ctrl.Request
 		NodeName:      builder.Status.Node,
 		ImageHostPath: builder.Spec.LocalHostPath,
 	}
+	if builder.Spec.Timeout != nil {
+		m.Timeout = builder.Spec.Timeout.Duration
+	}
+	m.PostCommitHookTimeout = core.PostCommitHookTimeout(builder.Spec.Commit)
 
 	for _, i := range pod.Status.ContainerStatuses {
-		if i.Name == builder.Spec.ContainerName {
+		if i.Name == builder.Spec.ContainerName && i.ContainerID != "" {
 			m.ContainerId = strings.Split(i.ContainerID, "://")[1]
 		}
 	}
+	return m
+}
 
-	klog.Infof("check for running tasks.  %s/%s", m.Name, m.JobNamespace)
-	_, err = r.ClientSet.BatchV1().Jobs(m.JobNamespace).Get(ctx, m.Name, metav1.GetOptions{})
-	if err != nil {
-		if !errors.IsNotFound(err) {
+// finalize resumes the container of a deleted ImageBuilder whose job paused it, then deletes
+// the jobs and releases the ImageBuilder. The builder job is gone before the recovery job starts,
+// so it can not pause the container again.
+func (r *ImageBuilderReconciler) finalize(ctx context.Context, builder *imagebuilderv1.ImageBuilder) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(builder, constant.FinalizerContainerRecovery) {
+		return ctrl.Result{}, nil
+	}
+
+	if meta.IsStatusConditionTrue(builder.Status.Conditions, constant.ConditionContainerPaused) {
+		jobName := core.JobName(builder.Namespace, builder.Name)
+		j := &batchv1.Job{}
+		err := r.Get(ctx, client.ObjectKey{Namespace: r.ManagerPod.Namespace, Name: jobName}, j)
+		if err == nil && core.OwnsJob(j, builder.Namespace, builder.Name) {
+			if j.DeletionTimestamp == nil {
+				klog.Infof("delete job %s/%s of deleted %s/%s", j.Namespace, j.Name, builder.Namespace, builder.Name)
+				err = r.Delete(ctx, j, client.PropagationPolicy(metav1.DeletePropagationForeground))
+				if err != nil && !errors.IsNotFound(err) {
+					return ctrl.Result{}, err
+				}
+			}
+			// the job watch brings us back once the job and its pods are gone
+			return ctrl.Result{RequeueAfter: jobStatusRequeueInterval}, nil
+		}
+		if client.IgnoreNotFound(err) != nil {
 			return ctrl.Result{}, err
 		}
-		err = r.Create(ctx, core.JobTemplate(m))
-		if err != nil {
-			klog.Errorf("failed to create builder job. err:%s", err)
+
+		pod := &corev1.Pod{}
+		err = r.APIReader.Get(ctx, client.ObjectKey{Namespace: builder.Spec.Namespace, Name: builder.Status.PodName}, pod)
+		if client.IgnoreNotFound(err) != nil {
 			return ctrl.Result{}, err
 		}
+		m := core.JobOptions{}
+		if err == nil {
+			m = r.jobOptions(builder, pod)
+		}
+		if m.ContainerId == "" {
+			// a deleted container is not paused anymore
+			klog.Warningf("container %q of pod %s/%s is gone, nothing to resume for deleted %s/%s",
+				builder.Spec.ContainerName, builder.Spec.Namespace, builder.Status.PodName, builder.Namespace, builder.Name)
+		} else {
+			message := fmt.Sprintf("%s/%s was deleted while container %s was paused", builder.Namespace, builder.Name, m.ContainerId)
+			done, err := r.recoverContainer(ctx, builder, m, message)
+			if err != nil || !done {
+				return ctrl.Result{RequeueAfter: jobStatusRequeueInterval}, err
+			}
+		}
+	}
+
+	r.deleteJob(ctx, builder.Namespace, builder.Name)
+	controllerutil.RemoveFinalizer(builder, constant.FinalizerContainerRecovery)
+	return ctrl.Result{}, client.IgnoreNotFound(r.Update(ctx, builder))
+}
+
+// recoverContainer runs the recovery job for a builder job that failed or was deleted while the
+// container was paused and returns whether the recovery finished. The recovery job reports a resumed container
+// itself, a failed recovery is recorded here.
+func (r *ImageBuilderReconciler) recoverContainer(ctx context.Context, builder *imagebuilderv1.ImageBuilder, m core.JobOptions, jobMessage string) (bool, error) {
+	j := &batchv1.Job{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: m.JobNamespace, Name: core.RecoveryJobName(m.Namespace, m.Name)}, j)
+	if err == nil && !core.OwnsJob(j, m.Namespace, m.Name) {
+		return false, fmt.Errorf("job %s/%s does not belong to %s/%s", j.Namespace, j.Name, m.Namespace, m.Name)
+	}
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return false, err
+		}
+		klog.Warningf("job %s/%s ended while container %s was paused, resume it", m.JobNamespace, core.JobName(m.Namespace, m.Name), m.ContainerId)
+		err = r.Create(ctx, core.RecoveryJobTemplate(m))
+		if err != nil && !errors.IsAlreadyExists(err) {
+			klog.Errorf("failed to create recovery job. err:%s", err)
+			return false, err
+		}
+		builder.SetCondition(constant.ConditionContainerRecovered, metav1.ConditionUnknown, constant.ReasonRecoveryJobCreated,
+			fmt.Sprintf("job ended while container %s was paused: %s", m.ContainerId, jobMessage))
+		return false, r.Status().Update(ctx, builder)
 	}
 
-	for {
-		j, err := r.ClientSet.BatchV1().Jobs(m.JobNamespace).Get(ctx, m.Name, metav1.GetOptions{})
+	for _, condition := range j.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			// the recovery job updated the conditions, unless its status update failed
+			builder.SetCondition(constant.ConditionContainerPaused, metav1.ConditionFalse, constant.ReasonContainerResumed, "")
+			if !meta.IsStatusConditionTrue(builder.Status.Conditions, constant.ConditionContainerRecovered) {
+				builder.SetCondition(constant.ConditionContainerRecovered, metav1.ConditionTrue, constant.ReasonContainerResumed,
+					fmt.Sprintf("recovery job %s/%s completed", j.Namespace, j.Name))
+			}
+			return true, nil
+		case batchv1.JobFailed:
+			klog.Errorf("recovery job %s/%s failed, container %s may still be paused", j.Namespace, j.Name, m.ContainerId)
+			builder.SetCondition(constant.ConditionContainerRecovered, metav1.ConditionFalse, constant.ReasonRecoveryFailed,
+				fmt.Sprintf("container %s may still be paused: %s", m.ContainerId, condition.Message))
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cleanupFinished deletes the job of a finished build, immediately on success and after
+// FailedJobRetention on failure, and the ImageBuilder itself once its TTL expired.
+func (r *ImageBuilderReconciler) cleanupFinished(ctx context.Context, builder *imagebuilderv1.ImageBuilder) (ctrl.Result, error) {
+	if builder.Status.CompletionTime == nil {
+		// finished before completionTime was recorded
+		now := metav1.Now()
+		builder.Status.CompletionTime = &now
+		return ctrl.Result{}, r.Status().Update(ctx, builder)
+	}
+	finished := time.Since(builder.Status.CompletionTime.Time)
 
-		if len(j.Status.Conditions) > 0 && j.Status.Conditions[0].Type == batchv1.JobComplete && err == nil {
-			err = r.updateStatusSuccess(ctx, builder)
-			break
+	var requeue time.Duration
+	if builder.Status.State == constant.Succeeded || finished >= r.FailedJobRetention {
+		r.deleteJob(ctx, builder.Namespace, builder.Name)
+	} else {
+		requeue = r.FailedJobRetention - finished
+	}
+
+	ttlSeconds := r.DefaultTTLSecondsAfterFinished
+	if builder.Spec.TTLSecondsAfterFinished != nil {
+		ttlSeconds = *builder.Spec.TTLSecondsAfterFinished
+	}
+	if ttlSeconds >= 0 {
+		remaining := time.Duration(ttlSeconds)*time.Second - finished
+		if remaining <= 0 {
+			klog.Infof("delete expired %s/%s", builder.Namespace, builder.Name)
+			r.deleteJob(ctx, builder.Namespace, builder.Name)
+			return ctrl.Result{}, client.IgnoreNotFound(r.Delete(ctx, builder))
 		}
+		if requeue == 0 || remaining < requeue {
+			requeue = remaining
+		}
+	}
+	return ctrl.Result{RequeueAfter: requeue}, nil
+}
 
-		if len(j.Status.Conditions) > 0 && j.Status.Conditions[0].Type == batchv1.JobFailed && err == nil {
-			err = r.updateStatusFailed(ctx, builder, j.Status.Conditions[0].Message)
-			break
+// deleteJob deletes the builder job and the recovery job of the ImageBuilder namespace/name.
+func (r *ImageBuilderReconciler) deleteJob(ctx context.Context, namespace, name string) {
+	background := metav1.DeletePropagationBackground
+	for _, jobName := range []string{core.JobName(namespace, name), core.RecoveryJobName(namespace, name)} {
+		j := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: r.ManagerPod.Namespace, Name: jobName}}
+		err := r.Delete(ctx, j, client.PropagationPolicy(background))
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Error("delete job error\n", err, "name:", jobName, "namespace:", r.ManagerPod.Namespace)
 		}
+	}
+}
 
+// deleteOrphanJob deletes the jobs of an ImageBuilder that no longer exists. ImageBuilders
+// with a job are kept by their finalizer until the container is resumed, this cleans up after
+// ImageBuilders deleted before the finalizer was added.
+func (r *ImageBuilderReconciler) deleteOrphanJob(ctx context.Context, key types.NamespacedName) error {
+	for _, jobName := range []string{core.JobName(key.Namespace, key.Name), core.RecoveryJobName(key.Namespace, key.Name)} {
+		j := &batchv1.Job{}
+		err := r.Get(ctx, client.ObjectKey{Namespace: r.ManagerPod.Namespace, Name: jobName}, j)
 		if err != nil {
-			err = r.updateStatusFailed(ctx, builder, err.Error())
-			break
+			if client.IgnoreNotFound(err) != nil {
+				return err
+			}
+			continue
+		}
+		if !core.OwnsJob(j, key.Namespace, key.Name) || j.DeletionTimestamp != nil {
+			continue
+		}
+		klog.Infof("delete job %s/%s of deleted %s", j.Namespace, j.Name, key)
+		background := metav1.DeletePropagationBackground
+		err = r.Delete(ctx, j, client.PropagationPolicy(background))
+		if err != nil && !errors.IsNotFound(err) {
+			return err
 		}
-
-		klog.Infof("get job status for '%s/%s'. createtime:%s", m.Name, m.JobNamespace, j.CreationTimestamp.String())
-		time.Sleep(10 * time.Second)
 	}
-	klog.Infof("save images complete for %s/%s", m.Name, m.JobNamespace)
-	return ctrl.Result{}, nil
+	return nil
 }
 
 func (r *ImageBuilderReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&imagebuilderv1.ImageBuilder{}).
+		Watches(&batchv1.Job{}, handler.EnqueueRequestsFromMapFunc(r.jobToImageBuilder)).
 		WithOptions(controller.Options{
 			MaxConcurrentReconciles: r.MaxWorkNum,
 		}).
 		Complete(r)
 }
 
+// jobToImageBuilder maps a builder job back to the ImageBuilder that created it.
+// The job lives in the manager namespace, so it cannot carry an owner reference.
+func (r *ImageBuilderReconciler) jobToImageBuilder(ctx context.Context, obj client.Object) []reconcile.Request {
+	labels := obj.GetLabels()
+	name, ok := labels[constant.LabelImageBuilderName]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{
+		Namespace: labels[constant.LabelImageBuilderNamespace],
+		Name:      name,
+	}}}
+}
+
 func (r *ImageBuilderReconciler) updateStatusSuccess(ctx context.Context, imageBuilder *imagebuilderv1.ImageBuilder) error {
 	klog.Errorf("save image %s/%s succeuss", imageBuilder.Namespace, imageBuilder.Name)
+	now := metav1.Now()
 	imageBuilder.Status.State = constant.Succeeded
+	imageBuilder.Status.CompletionTime = &now
+	imageBuilder.Status.ObservedGeneration = imageBuilder.Generation
+	imageBuilder.SetCondition(constant.ConditionReady, metav1.ConditionTrue, constant.ReasonJobSucceeded, "image build succeeded")
 	err := r.Status().Update(ctx, imageBuilder)
 	return err
 }
 
-func (r *ImageBuilderReconciler) updateStatusFailed(ctx context.Context, imageBuilder *imagebuilderv1.ImageBuilder, reason string) error {
+func (r *ImageBuilderReconciler) updateStatusFailed(ctx context.Context, imageBuilder *imagebuilderv1.ImageBuilder, reason, message string) error {
 	klog.Errorf("save image %s/%s failed", imageBuilder.Namespace, imageBuilder.Name)
+	now := metav1.Now()
 	imageBuilder.Status.State = constant.Failed
-	imageBuilder.Status.Reason = reason
+	imageBuilder.Status.Reason = message
+	imageBuilder.Status.CompletionTime = &now
+	imageBuilder.Status.ObservedGeneration = imageBuilder.Generation
+	imageBuilder.SetCondition(constant.ConditionReady, metav1.ConditionFalse, reason, message)
 	err := r.Status().Update(ctx, imageBuilder)
 	return err
 }
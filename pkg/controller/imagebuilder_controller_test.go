@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"context"
+	imagebuilderv1 "imagebuilder/api/v1"
+	"imagebuilder/pkg/constant"
+	"imagebuilder/pkg/core"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func newTestReconciler(t *testing.T, objects ...client.Object) *ImageBuilderReconciler {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := imagebuilderv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&imagebuilderv1.ImageBuilder{}, &batchv1.Job{}).
+		Build()
+	return &ImageBuilderReconciler{
+		Client:    c,
+		Scheme:    scheme,
+		APIReader: c,
+		ManagerPod: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "imagebuilder-system", Name: "manager"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Image: "imagebuilder:test"}}},
+		},
+	}
+}
+
+// newDeletedBuilder returns an ImageBuilder deleted while its job committed the container app of pod-0.
+func newDeletedBuilder(paused bool) *imagebuilderv1.ImageBuilder {
+	now := metav1.Now()
+	builder := &imagebuilderv1.ImageBuilder{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "default",
+			Name:              "ib",
+			DeletionTimestamp: &now,
+			Finalizers:        []string{constant.FinalizerContainerRecovery},
+		},
+		Spec: imagebuilderv1.ImageBuilderSpec{Namespace: "default", PodName: "pod-0", ContainerName: "app"},
+		Status: imagebuilderv1.ImageBuilderStatus{
+			State:   constant.Committing,
+			Node:    "node-1",
+			PodName: "pod-0",
+		},
+	}
+	if paused {
+		builder.SetCondition(constant.ConditionContainerPaused, metav1.ConditionTrue, constant.ReasonPausedForCommit, "")
+	}
+	return builder
+}
+
+func newTargetPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod-0"},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "app", ContainerID: "containerd://c0ffee"},
+		}},
+	}
+}
+
+func newBuilderJob(name string) *batchv1.Job {
+	return &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "imagebuilder-system",
+		Name:      name,
+		Labels: map[string]string{
+			constant.LabelImageBuilderName:      "ib",
+			constant.LabelImageBuilderNamespace: "default",
+		},
+	}}
+}
+
+func reconcileBuilder(t *testing.T, r *ImageBuilderReconciler) {
+	t.Helper()
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "ib"}}); err != nil {
+		t.Fatalf("Reconcile() error: %v", err)
+	}
+}
+
+func jobExists(t *testing.T, r *ImageBuilderReconciler, name string) bool {
+	t.Helper()
+	err := r.Get(context.Background(), client.ObjectKey{Namespace: "imagebuilder-system", Name: name}, &batchv1.Job{})
+	if err != nil && !errors.IsNotFound(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestFinalizeDeletedWhilePaused(t *testing.T) {
+	ctx := context.Background()
+	jobName, recoveryJobName := core.JobName("default", "ib"), core.RecoveryJobName("default", "ib")
+	r := newTestReconciler(t, newDeletedBuilder(true), newTargetPod(), newBuilderJob(jobName))
+
+	// the builder job is deleted first, it must not pause the container again
+	reconcileBuilder(t, r)
+	if jobExists(t, r, jobName) {
+		t.Fatalf("builder job %s was not deleted", jobName)
+	}
+	if jobExists(t, r, recoveryJobName) {
+		t.Fatalf("recovery job %s created before the builder job was gone", recoveryJobName)
+	}
+
+	reconcileBuilder(t, r)
+	recoveryJob := &batchv1.Job{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "imagebuilder-system", Name: recoveryJobName}, recoveryJob); err != nil {
+		t.Fatalf("recovery job not created: %v", err)
+	}
+	wantArgs := []string{"recover", "--name", "ib", "--namespace", "default", "--container-id", "c0ffee"}
+	if args := recoveryJob.Spec.Template.Spec.Containers[0].Args; !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("recovery job args = %q, want %q", args, wantArgs)
+	}
+	builder := &imagebuilderv1.ImageBuilder{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "ib"}, builder); err != nil {
+		t.Fatalf("ImageBuilder released before the container was resumed: %v", err)
+	}
+	if meta.FindStatusCondition(builder.Status.Conditions, constant.ConditionContainerRecovered) == nil {
+		t.Errorf("ContainerRecovered condition not set")
+	}
+
+	// still running, the ImageBuilder is kept
+	reconcileBuilder(t, r)
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "ib"}, builder); err != nil {
+		t.Fatalf("ImageBuilder released while the recovery job runs: %v", err)
+	}
+
+	recoveryJob.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	if err := r.Status().Update(ctx, recoveryJob); err != nil {
+		t.Fatal(err)
+	}
+	reconcileBuilder(t, r)
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "ib"}, builder); !errors.IsNotFound(err) {
+		t.Errorf("ImageBuilder not released after the recovery: %v", err)
+	}
+	if jobExists(t, r, recoveryJobName) {
+		t.Errorf("recovery job %s was not deleted", recoveryJobName)
+	}
+}
+
+func TestFinalizeDeleted(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder *imagebuilderv1.ImageBuilder
+		objects []client.Object
+	}{
+		{
+			name:    "not paused",
+			builder: newDeletedBuilder(false),
+			objects: []client.Object{newTargetPod(), newBuilderJob(core.JobName("default", "ib"))},
+		},
+		{
+			name:    "paused container gone with its pod",
+			builder: newDeletedBuilder(true),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestReconciler(t, append(tt.objects, tt.builder)...)
+			reconcileBuilder(t, r)
+			err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "ib"}, &imagebuilderv1.ImageBuilder{})
+			if !errors.IsNotFound(err) {
+				t.Errorf("ImageBuilder not released: %v", err)
+			}
+			for _, name := range []string{core.JobName("default", "ib"), core.RecoveryJobName("default", "ib")} {
+				if jobExists(t, r, name) {
+					t.Errorf("job %s exists after the ImageBuilder was released", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	"github.com/robfig/cron/v3"
+	imagebuilderv1 "imagebuilder/api/v1"
+	"imagebuilder/pkg/constant"
+	"imagebuilder/pkg/core"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sort"
+	"text/template"
+	"time"
+)
+
+const defaultTagTemplate = "{{ .Timestamp }}"
+
+// maxMissedSchedules caps the missed start times counted like the CronJob controller does, a schedule
+// that missed more runs, e.g. after a long controller outage, skips them.
+const maxMissedSchedules = 100
+
+type ImageBuilderScheduleReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+func (r *ImageBuilderScheduleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	schedule := &imagebuilderv1.ImageBuilderSchedule{}
+	err := r.Get(ctx, req.NamespacedName, schedule)
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if schedule.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
+	}
+
+	children := &imagebuilderv1.ImageBuilderList{}
+	err = r.List(ctx, children, client.InNamespace(schedule.Namespace), client.MatchingLabels{constant.LabelSchedule: schedule.Name})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var active, succeeded, failed []*imagebuilderv1.ImageBuilder
+	for i := range children.Items {
+		child := &children.Items[i]
+		switch child.Status.State {
+		case constant.Succeeded:
+			succeeded = append(succeeded, child)
+		case constant.Failed:
+			failed = append(failed, child)
+		default:
+			active = append(active, child)
+		}
+	}
+
+	schedule.Status.Active = nil
+	for _, child := range active {
+		schedule.Status.Active = append(schedule.Status.Active, child.Name)
+	}
+	for _, child := range succeeded {
+		if child.Status.CompletionTime == nil {
+			continue
+		}
+		if schedule.Status.LastSuccessfulTime == nil || schedule.Status.LastSuccessfulTime.Before(child.Status.CompletionTime) {
+			schedule.Status.LastSuccessfulTime = child.Status.CompletionTime
+		}
+	}
+
+	r.deleteHistory(ctx, succeeded, schedule.SuccessfulHistoryLimit())
+	r.deleteHistory(ctx, failed, schedule.FailedHistoryLimit())
+
+	sched, err := core.ParseSchedule(schedule.Spec.Schedule)
+	if err != nil {
+		// nothing to retry until the spec is fixed
+		klog.Errorf("schedule %s/%s: invalid schedule %q: %v", schedule.Namespace, schedule.Name, schedule.Spec.Schedule, err)
+		return ctrl.Result{}, r.Status().Update(ctx, schedule)
+	}
+
+	now := time.Now()
+	if schedule.Spec.Suspend {
+		return ctrl.Result{}, r.Status().Update(ctx, schedule)
+	}
+
+	earliest := schedule.CreationTimestamp.Time
+	if schedule.Status.LastScheduleTime != nil {
+		earliest = schedule.Status.LastScheduleTime.Time
+	}
+	scheduledTime, missed := mostRecentScheduleTime(sched, earliest, now)
+	requeue := ctrl.Result{RequeueAfter: sched.Next(now).Sub(now)}
+	if missed == 0 {
+		return requeue, r.Status().Update(ctx, schedule)
+	}
+	if missed > maxMissedSchedules {
+		message := fmt.Sprintf("more than %d start times missed since %s, skipped them", maxMissedSchedules, earliest.Format(time.RFC3339))
+		klog.Warningf("schedule %s/%s: %s", schedule.Namespace, schedule.Name, message)
+		schedule.SetCondition(constant.ConditionScheduled, metav1.ConditionFalse, constant.ReasonMissedTooMany, message)
+		schedule.Status.LastScheduleTime = &metav1.Time{Time: now}
+		return requeue, r.Status().Update(ctx, schedule)
+	}
+
+	switch schedule.ConcurrencyPolicy() {
+	case imagebuilderv1.ForbidConcurrent:
+		if len(active) > 0 {
+			klog.Infof("schedule %s/%s: skip run at %s, %d runs still active", schedule.Namespace, schedule.Name, scheduledTime, len(active))
+			schedule.Status.LastScheduleTime = &metav1.Time{Time: scheduledTime}
+			return requeue, r.Status().Update(ctx, schedule)
+		}
+	case imagebuilderv1.ReplaceConcurrent:
+		for _, child := range active {
+			klog.Infof("schedule %s/%s: replace active run %s", schedule.Namespace, schedule.Name, child.Name)
+			err = r.Delete(ctx, child, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil && !errors.IsNotFound(err) {
+				return ctrl.Result{}, err
+			}
+		}
+		schedule.Status.Active = nil
+	}
+
+	child, err := r.imageBuilderForRun(schedule, scheduledTime)
+	if err == nil {
+		err = r.Create(ctx, child)
+		if errors.IsAlreadyExists(err) {
+			err = nil
+		} else if err != nil && !errors.IsInvalid(err) && !errors.IsForbidden(err) && !errors.IsBadRequest(err) {
+			klog.Errorf("schedule %s/%s: create %s error: %v", schedule.Namespace, schedule.Name, child.Name, err)
+			return ctrl.Result{}, err
+		}
+	}
+	schedule.Status.LastScheduleTime = &metav1.Time{Time: scheduledTime}
+	if err != nil {
+		// the run is rejected until the template is fixed, skip it instead of retrying
+		message := fmt.Sprintf("run at %s skipped: %v", scheduledTime.Format(time.RFC3339), err)
+		klog.Errorf("schedule %s/%s: %s", schedule.Namespace, schedule.Name, message)
+		schedule.SetCondition(constant.ConditionScheduled, metav1.ConditionFalse, constant.ReasonRunRejected, message)
+		return requeue, r.Status().Update(ctx, schedule)
+	}
+	klog.Infof("schedule %s/%s: created %s for %s", schedule.Namespace, schedule.Name, child.Name, scheduledTime)
+
+	schedule.Status.Active = append(schedule.Status.Active, child.Name)
+	schedule.SetCondition(constant.ConditionScheduled, metav1.ConditionTrue, constant.ReasonRunCreated, fmt.Sprintf("created %s", child.Name))
+	return requeue, r.Status().Update(ctx, schedule)
+}
+
+func (r *ImageBuilderScheduleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&imagebuilderv1.ImageBuilderSchedule{}).
+		Owns(&imagebuilderv1.ImageBuilder{}).
+		Complete(r)
+}
+
+// deleteHistory deletes the oldest finished runs beyond limit.
+func (r *ImageBuilderScheduleReconciler) deleteHistory(ctx context.Context, finished []*imagebuilderv1.ImageBuilder, limit int) {
+	if len(finished) <= limit {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].CreationTimestamp.Before(&finished[j].CreationTimestamp)
+	})
+	for _, child := range finished[:len(finished)-limit] {
+		err := r.Delete(ctx, child, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Errorf("delete run %s/%s error: %v", child.Namespace, child.Name, err)
+		}
+	}
+}
+
+// imageBuilderForRun renders the ImageBuilder of the run scheduled at scheduledTime. The name is
+// derived from the scheduled time, so a run is never created twice.
+func (r *ImageBuilderScheduleReconciler) imageBuilderForRun(schedule *imagebuilderv1.ImageBuilderSchedule, scheduledTime time.Time) (*imagebuilderv1.ImageBuilder, error) {
+	tag, err := renderTag(schedule, scheduledTime)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{}
+	for k, v := range schedule.Spec.Template.Metadata.Labels {
+		labels[k] = v
+	}
+	labels[constant.LabelSchedule] = schedule.Name
+	annotations := map[string]string{}
+	for k, v := range schedule.Spec.Template.Metadata.Annotations {
+		annotations[k] = v
+	}
+	annotations[constant.AnnotationScheduledTime] = scheduledTime.Format(time.RFC3339)
+
+	child := &imagebuilderv1.ImageBuilder{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-%d", schedule.Name, scheduledTime.Unix()/60),
+			Namespace:   schedule.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: *schedule.Spec.Template.Spec.DeepCopy(),
+	}
+	if child.Spec.To != "" {
+		if child.Spec.To, err = withTag(child.Spec.To, tag); err != nil {
+			return nil, fmt.Errorf("invalid template.spec.to: %w", err)
+		}
+	}
+	for i := range child.Spec.Destinations {
+		destination := &child.Spec.Destinations[i]
+		if destination.To, err = withTag(destination.To, tag); err != nil {
+			return nil, fmt.Errorf("invalid template.spec.destinations[%d].to: %w", i, err)
+		}
+	}
+	if err = controllerutil.SetControllerReference(schedule, child, r.Scheme); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+type tagTemplateData struct {
+	ScheduleName string
+	Timestamp    string
+	Date         string
+	Unix         int64
+}
+
+// renderTag renders the tag template, it replaces the tag of template.spec.to and of every destination.
+func renderTag(schedule *imagebuilderv1.ImageBuilderSchedule, scheduledTime time.Time) (string, error) {
+	tagTemplate := schedule.Spec.TagTemplate
+	if tagTemplate == "" {
+		tagTemplate = defaultTagTemplate
+	}
+	tmpl, err := template.New("tag").Parse(tagTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid tagTemplate: %w", err)
+	}
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, tagTemplateData{
+		ScheduleName: schedule.Name,
+		Timestamp:    scheduledTime.UTC().Format("20060102-150405"),
+		Date:         scheduledTime.UTC().Format("20060102"),
+		Unix:         scheduledTime.Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("invalid tagTemplate: %w", err)
+	}
+
+	if _, err = refdocker.ParseNormalizedNamed("imagebuilder:" + buf.String()); err != nil {
+		return "", fmt.Errorf("tag %q rendered from tagTemplate: %w", buf.String(), err)
+	}
+	return buf.String(), nil
+}
+
+// withTag replaces the tag of ref.
+func withTag(ref, tag string) (string, error) {
+	named, err := refdocker.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", err
+	}
+	tagged, err := refdocker.WithTag(refdocker.TrimNamed(named), tag)
+	if err != nil {
+		return "", err
+	}
+	return refdocker.FamiliarString(tagged), nil
+}
+
+// mostRecentScheduleTime returns the latest schedule time after earliest and not after now, and the
+// number of schedule times in between. It stops counting after maxMissedSchedules.
+func mostRecentScheduleTime(sched cron.Schedule, earliest, now time.Time) (time.Time, int) {
+	var last time.Time
+	missed := 0
+	for t := sched.Next(earliest); !t.After(now) && missed <= maxMissedSchedules; t = sched.Next(t) {
+		last = t
+		missed++
+	}
+	return last, missed
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ApplyChanges applies Dockerfile-style instructions to config, the same set docker accepts for
+// "docker commit --change": CMD, ENTRYPOINT, ENV, EXPOSE, LABEL, STOPSIGNAL, USER, VOLUME and WORKDIR.
+// Unlike docker, variables in the arguments are not expanded.
+func ApplyChanges(config *ocispec.ImageConfig, changes []string) error {
+	cmdSet := false
+	for _, change := range changes {
+		directive, args, _ := strings.Cut(strings.TrimSpace(change), " ")
+		args = strings.TrimSpace(args)
+		if args == "" {
+			return fmt.Errorf("change %q: missing arguments", change)
+		}
+		var err error
+		switch strings.ToUpper(directive) {
+		case "CMD":
+			config.Cmd, err = parseCommand(args)
+			cmdSet = true
+		case "ENTRYPOINT":
+			config.Entrypoint, err = parseCommand(args)
+			// like a Dockerfile, a new entrypoint drops the command of the base image
+			if !cmdSet {
+				config.Cmd = nil
+			}
+		case "ENV":
+			err = applyKeyValues(args, func(key, value string) {
+				config.Env = setEnv(config.Env, key, value)
+			})
+		case "LABEL":
+			err = applyKeyValues(args, func(key, value string) {
+				if config.Labels == nil {
+					config.Labels = map[string]string{}
+				}
+				config.Labels[key] = value
+			})
+		case "EXPOSE":
+			err = applyExpose(config, strings.Fields(args))
+		case "VOLUME":
+			var volumes []string
+			volumes, err = parseList(args)
+			for _, volume := range volumes {
+				if config.Volumes == nil {
+					config.Volumes = map[string]struct{}{}
+				}
+				config.Volumes[volume] = struct{}{}
+			}
+		case "USER":
+			config.User = args
+		case "WORKDIR":
+			if path.IsAbs(args) {
+				config.WorkingDir = path.Clean(args)
+			} else {
+				config.WorkingDir = path.Join("/", config.WorkingDir, args)
+			}
+		case "STOPSIGNAL":
+			config.StopSignal = args
+		default:
+			return fmt.Errorf("change %q: unsupported instruction %s", change, directive)
+		}
+		if err != nil {
+			return fmt.Errorf("change %q: %w", change, err)
+		}
+	}
+	return nil
+}
+
+// parseCommand parses the exec form ["a", "b"] or wraps the shell form in /bin/sh -c.
+func parseCommand(args string) ([]string, error) {
+	if strings.HasPrefix(args, "[") {
+		var command []string
+		if err := json.Unmarshal([]byte(args), &command); err != nil {
+			return nil, fmt.Errorf("malformed json: %w", err)
+		}
+		return command, nil
+	}
+	return []string{"/bin/sh", "-c", args}, nil
+}
+
+// parseList parses a json array or whitespace separated words.
+func parseList(args string) ([]string, error) {
+	if strings.HasPrefix(args, "[") {
+		var list []string
+		if err := json.Unmarshal([]byte(args), &list); err != nil {
+			return nil, fmt.Errorf("malformed json: %w", err)
+		}
+		return list, nil
+	}
+	return strings.Fields(args), nil
+}
+
+// applyKeyValues parses "k1=v1 k2=v2" or the legacy "key value" form of ENV and LABEL.
+func applyKeyValues(args string, apply func(key, value string)) error {
+	words, err := splitWords(args)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(words[0], "=") {
+		key, value, _ := strings.Cut(args, " ")
+		apply(key, strings.TrimSpace(value))
+		return nil
+	}
+	for _, word := range words {
+		key, value, ok := strings.Cut(word, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("%q is not of the form key=value", word)
+		}
+		apply(key, value)
+	}
+	return nil
+}
+
+func applyExpose(config *ocispec.ImageConfig, ports []string) error {
+	for _, port := range ports {
+		number, proto, ok := strings.Cut(port, "/")
+		if !ok {
+			proto = "tcp"
+		}
+		proto = strings.ToLower(proto)
+		if proto != "tcp" && proto != "udp" && proto != "sctp" {
+			return fmt.Errorf("invalid protocol in port %q", port)
+		}
+		first, last, isRange := strings.Cut(number, "-")
+		if !validPort(first) || (isRange && !validPort(last)) {
+			return fmt.Errorf("invalid port %q", port)
+		}
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = map[string]struct{}{}
+		}
+		config.ExposedPorts[number+"/"+proto] = struct{}{}
+	}
+	return nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// setEnv replaces or appends key in env.
+func setEnv(env []string, key, value string) []string {
+	for i, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); k == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
+// splitWords splits s at whitespace outside of single or double quotes and removes the quotes.
+// A backslash escapes the next character outside of single quotes.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"reflect"
+	"testing"
+)
+
+func TestApplyChanges(t *testing.T) {
+	base := func() ocispec.ImageConfig {
+		return ocispec.ImageConfig{
+			Env:        []string{"PATH=/usr/bin", "LANG=C"},
+			Cmd:        []string{"bash"},
+			WorkingDir: "/app",
+		}
+	}
+	tests := []struct {
+		name    string
+		changes []string
+		want    func(config *ocispec.ImageConfig)
+		wantErr bool
+	}{
+		{
+			name:    "cmd exec form",
+			changes: []string{`CMD ["python", "main.py"]`},
+			want:    func(c *ocispec.ImageConfig) { c.Cmd = []string{"python", "main.py"} },
+		},
+		{
+			name:    "cmd shell form",
+			changes: []string{"CMD python main.py"},
+			want:    func(c *ocispec.ImageConfig) { c.Cmd = []string{"/bin/sh", "-c", "python main.py"} },
+		},
+		{
+			name:    "lower case directive",
+			changes: []string{"cmd python"},
+			want:    func(c *ocispec.ImageConfig) { c.Cmd = []string{"/bin/sh", "-c", "python"} },
+		},
+		{
+			name:    "entrypoint drops the base cmd",
+			changes: []string{`ENTRYPOINT ["/entrypoint.sh"]`},
+			want: func(c *ocispec.ImageConfig) {
+				c.Entrypoint = []string{"/entrypoint.sh"}
+				c.Cmd = nil
+			},
+		},
+		{
+			name:    "entrypoint keeps a cmd set before",
+			changes: []string{`CMD ["serve"]`, `ENTRYPOINT ["/entrypoint.sh"]`},
+			want: func(c *ocispec.ImageConfig) {
+				c.Entrypoint = []string{"/entrypoint.sh"}
+				c.Cmd = []string{"serve"}
+			},
+		},
+		{
+			name:    "env key=value",
+			changes: []string{`ENV LANG=C.UTF-8 MODE="a b" EMPTY=`},
+			want:    func(c *ocispec.ImageConfig) { c.Env = []string{"PATH=/usr/bin", "LANG=C.UTF-8", "MODE=a b", "EMPTY="} },
+		},
+		{
+			name:    "env legacy form",
+			changes: []string{"ENV GREETING hello world"},
+			want:    func(c *ocispec.ImageConfig) { c.Env = []string{"PATH=/usr/bin", "LANG=C", "GREETING=hello world"} },
+		},
+		{
+			name:    "label",
+			changes: []string{`LABEL version=1 "org.example/desc"='a model'`},
+			want: func(c *ocispec.ImageConfig) {
+				c.Labels = map[string]string{"version": "1", "org.example/desc": "a model"}
+			},
+		},
+		{
+			name:    "expose",
+			changes: []string{"EXPOSE 80 53/UDP 8000-8010/tcp"},
+			want: func(c *ocispec.ImageConfig) {
+				c.ExposedPorts = map[string]struct{}{"80/tcp": {}, "53/udp": {}, "8000-8010/tcp": {}}
+			},
+		},
+		{
+			name:    "volume json",
+			changes: []string{`VOLUME ["/data", "/cache"]`},
+			want:    func(c *ocispec.ImageConfig) { c.Volumes = map[string]struct{}{"/data": {}, "/cache": {}} },
+		},
+		{
+			name:    "volume words",
+			changes: []string{"VOLUME /data /cache"},
+			want:    func(c *ocispec.ImageConfig) { c.Volumes = map[string]struct{}{"/data": {}, "/cache": {}} },
+		},
+		{
+			name:    "user",
+			changes: []string{"USER 1000:1000"},
+			want:    func(c *ocispec.ImageConfig) { c.User = "1000:1000" },
+		},
+		{
+			name:    "absolute workdir",
+			changes: []string{"WORKDIR /srv/../opt"},
+			want:    func(c *ocispec.ImageConfig) { c.WorkingDir = "/opt" },
+		},
+		{
+			name:    "relative workdir",
+			changes: []string{"WORKDIR src"},
+			want:    func(c *ocispec.ImageConfig) { c.WorkingDir = "/app/src" },
+		},
+		{
+			name:    "stopsignal",
+			changes: []string{"STOPSIGNAL SIGINT"},
+			want:    func(c *ocispec.ImageConfig) { c.StopSignal = "SIGINT" },
+		},
+		{name: "unsupported directive", changes: []string{"RUN make"}, wantErr: true},
+		{name: "missing arguments", changes: []string{"USER "}, wantErr: true},
+		{name: "malformed cmd json", changes: []string{`CMD ["python"`}, wantErr: true},
+		{name: "malformed volume json", changes: []string{`VOLUME ["/data"`}, wantErr: true},
+		{name: "env without key", changes: []string{"ENV A=1 =2"}, wantErr: true},
+		{name: "env without value", changes: []string{"ENV A=1 B"}, wantErr: true},
+		{name: "unterminated quote", changes: []string{`LABEL a="b`}, wantErr: true},
+		{name: "invalid port", changes: []string{"EXPOSE 70000"}, wantErr: true},
+		{name: "invalid port range", changes: []string{"EXPOSE 80-x"}, wantErr: true},
+		{name: "invalid protocol", changes: []string{"EXPOSE 80/icmp"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := base()
+			err := ApplyChanges(&config, tt.changes)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ApplyChanges(%q) succeeded, want an error", tt.changes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyChanges(%q): %v", tt.changes, err)
+			}
+			want := base()
+			tt.want(&want)
+			if !reflect.DeepEqual(config, want) {
+				t.Errorf("ApplyChanges(%q) = %+v, want %+v", tt.changes, config, want)
+			}
+		})
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "a b\tc", want: []string{"a", "b", "c"}},
+		{in: "  a  ", want: []string{"a"}},
+		{in: "", want: nil},
+		{in: `a="b c" d`, want: []string{"a=b c", "d"}},
+		{in: `a='b "c"'`, want: []string{`a=b "c"`}},
+		{in: `a=b\ c`, want: []string{"a=b c"}},
+		{in: `a='b\c'`, want: []string{`a=b\c`}},
+		{in: `a="b\"c"`, want: []string{`a=b"c`}},
+		{in: `a="" b`, want: []string{"a=", "b"}},
+		{in: `""`, want: []string{""}},
+		{in: `a="b`, wantErr: true},
+		{in: `a='b`, wantErr: true},
+		{in: `a\`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := splitWords(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("splitWords(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitWords(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitWords(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	v1 "imagebuilder/api/v1"
+	"strings"
+	"time"
+)
+
+// imageConfig returns the config of img, nil if img is unknown.
+func imageConfig(img *ocispec.Image) *ocispec.ImageConfig {
+	if img == nil {
+		return nil
+	}
+	return &img.Config
+}
+
+// squashFrom returns the index of the first layer merged by mode. base is the image the container
+// was created from, diffIDs are the layers of the committed image.
+func squashFrom(mode v1.SquashMode, base *ocispec.Image, diffIDs []digest.Digest) (int, error) {
+	if mode != v1.SquashOnBase {
+		return 0, nil
+	}
+	if base == nil {
+		return 0, fmt.Errorf("squash onBase: the original image is unknown")
+	}
+	from := len(base.RootFS.DiffIDs)
+	if from > len(diffIDs) {
+		return 0, fmt.Errorf("squash onBase: the image has less layers than the original image")
+	}
+	for i, diffID := range base.RootFS.DiffIDs {
+		if diffIDs[i] != diffID {
+			return 0, fmt.Errorf("squash onBase: layer %d differs from the original image", i)
+		}
+	}
+	return from, nil
+}
+
+func squashHistoryEntry(mode v1.SquashMode) ocispec.History {
+	now := time.Now()
+	return ocispec.History{
+		Created:   &now,
+		CreatedBy: "imagebuilder squash " + string(mode),
+	}
+}
+
+// updateConfig applies the commit options to config, the config of the committed image. base is
+// the config of the image the container was created from, nil if it is unknown. changesApplied
+// tells that the runtime applied Changes during the commit already.
+func (o CommitOptions) updateConfig(config, base *ocispec.ImageConfig, changesApplied bool) error {
+	var baseEnv []string
+	if base != nil {
+		baseEnv = base.Env
+		if baseEnv == nil {
+			baseEnv = []string{}
+		}
+	}
+	config.Env = o.filterEnv(config.Env, baseEnv)
+
+	if o.PreserveImageConfig {
+		if base == nil {
+			return fmt.Errorf("preserveImageConfig: config of the original image is unknown")
+		}
+		// instructions applied by the runtime win over the original image
+		changed := map[string]bool{}
+		if changesApplied {
+			for _, change := range o.Changes {
+				directive, _, _ := strings.Cut(strings.TrimSpace(change), " ")
+				changed[strings.ToUpper(directive)] = true
+			}
+		}
+		if !changed["ENTRYPOINT"] {
+			config.Entrypoint = base.Entrypoint
+		}
+		if !changed["CMD"] && !changed["ENTRYPOINT"] {
+			config.Cmd = base.Cmd
+		}
+		if !changed["WORKDIR"] {
+			config.WorkingDir = base.WorkingDir
+		}
+		if !changed["USER"] {
+			config.User = base.User
+		}
+	}
+
+	if changesApplied {
+		return nil
+	}
+	return ApplyChanges(config, o.Changes)
+}
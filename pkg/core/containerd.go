@@ -2,9 +2,11 @@ package core
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/reference"
 	refdocker "github.com/containerd/containerd/reference/docker"
 	"github.com/containerd/containerd/remotes"
@@ -12,45 +14,169 @@ import (
 	dockerconfig "github.com/containerd/containerd/remotes/docker/config"
 	"github.com/containerd/nerdctl/pkg/api/types"
 	"github.com/containerd/nerdctl/pkg/cmd/container"
+	"github.com/containerd/nerdctl/pkg/cmd/image"
+	"github.com/containerd/nerdctl/pkg/imgutil"
 	"github.com/containerd/nerdctl/pkg/imgutil/push"
 	"github.com/containerd/nerdctl/pkg/platformutil"
 	"github.com/containerd/nerdctl/pkg/signutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	v1 "imagebuilder/api/v1"
+	"io"
 	"k8s.io/klog/v2"
 	"os"
+	"time"
 )
 
 type Containerd struct {
 	ContainerdClient *containerd.Client
 }
 
-func (r *Containerd) Commit(ctx context.Context, containerID, to string) error {
+func (r *Containerd) Commit(ctx context.Context, containerID, to string, commitOptions CommitOptions) error {
 	options := types.ContainerCommitOptions{
-		Stdout: os.Stdout,
-		Pause:  true,
+		Stdout:  os.Stdout,
+		Pause:   commitOptions.Pause,
+		Author:  commitOptions.Author,
+		Message: commitOptions.Message,
 	}
-	err := container.Commit(ctx, r.ContainerdClient, to, containerID, options)
+	named, err := refdocker.ParseDockerRef(to)
+	if err != nil {
+		return err
+	}
+	base := r.baseImage(ctx, containerID)
+	err = container.Commit(ctx, r.ContainerdClient, to, containerID, options)
 	if err != nil {
 		klog.Errorf("containerdCommit error: %v", err)
 		return err
 	}
+	// nerdctl only applies CMD and ENTRYPOINT, so all changes are applied to the committed config
+	err = r.updateImage(ctx, named.String(), func(ctx context.Context, manifest *ocispec.Manifest, config *ocispec.Image) error {
+		if err := r.excludePaths(ctx, manifest, config, commitOptions.ExcludePaths); err != nil {
+			return fmt.Errorf("exclude paths: %w", err)
+		}
+		if err := r.addFiles(ctx, manifest, config, commitOptions.AddFiles); err != nil {
+			return fmt.Errorf("add files: %w", err)
+		}
+		if err := r.squash(ctx, manifest, config, base, commitOptions.Squash); err != nil {
+			return fmt.Errorf("squash: %w", err)
+		}
+		return commitOptions.updateConfig(&config.Config, imageConfig(base), false)
+	})
+	if err != nil {
+		return fmt.Errorf("update image config: %w", err)
+	}
 	klog.Infof("containerdCommit success: %v", to)
 	return err
 }
 
-func (r *Containerd) Push(ctx context.Context, rawRef, Username, Password string) error {
+// excludePaths rewrites the committed layer, the last one of manifest, without the entries
+// matching patterns. The layer is kept when nothing matches.
+func (r *Containerd) excludePaths(ctx context.Context, manifest *ocispec.Manifest, config *ocispec.Image, patterns []string) error {
+	if len(patterns) == 0 || len(manifest.Layers) == 0 || len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return nil
+	}
+	cs := r.ContainerdClient.ContentStore()
+	top := len(manifest.Layers) - 1
+	exclude := excludeMatcher(patterns)
+	desc, diffID, err := writeLayer(ctx, cs, layerMediaType(manifest), func(w io.Writer) (bool, error) {
+		rc, err := openLayer(ctx, cs, manifest.Layers[top])
+		if err != nil {
+			return false, err
+		}
+		defer rc.Close()
+		excluded, err := filterLayer(rc, w, exclude)
+		klog.Infof("excluded %d entries from the committed layer", excluded)
+		return excluded > 0, err
+	})
+	if err != nil || desc.Digest == "" {
+		return err
+	}
+	manifest.Layers[top] = desc
+	config.RootFS.DiffIDs[top] = diffID
+	return nil
+}
+
+// addFiles appends a layer holding files to manifest.
+func (r *Containerd) addFiles(ctx context.Context, manifest *ocispec.Manifest, config *ocispec.Image, files []File) error {
+	if len(files) == 0 {
+		return nil
+	}
+	desc, diffID, err := writeLayer(ctx, r.ContainerdClient.ContentStore(), layerMediaType(manifest), func(w io.Writer) (bool, error) {
+		return true, writeFilesLayer(w, files)
+	})
+	if err != nil {
+		return err
+	}
+	manifest.Layers = append(manifest.Layers, desc)
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	config.History = append(config.History, addFilesHistory(files))
+	return nil
+}
+
+// squash merges the layers selected by mode into one layer.
+func (r *Containerd) squash(ctx context.Context, manifest *ocispec.Manifest, config *ocispec.Image, base *ocispec.Image, mode v1.SquashMode) error {
+	if mode == "" || len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return nil
+	}
+	from, err := squashFrom(mode, base, config.RootFS.DiffIDs)
+	if err != nil || len(manifest.Layers)-from < 2 {
+		return err
+	}
+
+	cs := r.ContainerdClient.ContentStore()
+	var layers []layerOpener
+	for _, layer := range manifest.Layers[from:] {
+		layer := layer
+		layers = append(layers, func() (io.ReadCloser, error) {
+			return openLayer(ctx, cs, layer)
+		})
+	}
+	desc, diffID, err := writeLayer(ctx, cs, layerMediaType(manifest), func(w io.Writer) (bool, error) {
+		return true, squashLayers(layers, w, from > 0)
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("squashed %d layers into %s", len(layers), desc.Digest)
+	manifest.Layers = append(manifest.Layers[:from:from], desc)
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs[:from:from], diffID)
+	config.History = squashHistory(config.History, from, squashHistoryEntry(mode))
+	return nil
+}
+
+// baseImage returns the config of the image the container was created from, nil if it is unknown.
+func (r *Containerd) baseImage(ctx context.Context, containerID string) *ocispec.Image {
+	c, err := r.ContainerdClient.LoadContainer(ctx, containerID)
+	if err != nil {
+		klog.Warningf("load container %s: %v", containerID, err)
+		return nil
+	}
+	img, err := c.Image(ctx)
+	if err != nil {
+		klog.Warningf("image of container %s: %v", containerID, err)
+		return nil
+	}
+	config, _, err := imgutil.ReadImageConfig(ctx, img)
+	if err != nil {
+		klog.Warningf("config of image %s: %v", img.Name(), err)
+		return nil
+	}
+	return &config
+}
+
+func (r *Containerd) Push(ctx context.Context, rawRef string, pushOptions PushOptions) (string, error) {
 	options := types.ImagePushOptions{
 		Stdout: os.Stdout,
 	}
-	options.GOptions.InsecureRegistry = true
+	options.GOptions.InsecureRegistry = pushOptions.TLS.Insecure()
 	named, err := refdocker.ParseDockerRef(rawRef)
 	if err != nil {
-		return err
+		return "", err
 	}
 	ref := named.String()
 
 	platMC, err := platformutil.NewMatchComparer(options.AllPlatforms, options.Platforms)
 	if err != nil {
-		return err
+		return "", err
 	}
 	pushRef := ref
 
@@ -59,9 +185,9 @@ func (r *Containerd) Push(ctx context.Context, rawRef, Username, Password string
 	pushFunc := func(remote remotes.Resolver) error {
 		return push.Push(ctx, r.ContainerdClient, remote, pushTracker, options.Stdout, pushRef, ref, platMC, options.AllowNondistributableArtifacts, options.Quiet)
 	}
-	ho, err := NewHostOptions(Username, Password)
+	ho, err := NewHostOptions(pushOptions)
 	if err != nil {
-		return err
+		return "", err
 	}
 	resolverOpts := docker.ResolverOptions{
 		Tracker: pushTracker,
@@ -72,43 +198,236 @@ func (r *Containerd) Push(ctx context.Context, rawRef, Username, Password string
 	err = pushFunc(resolver)
 	if err != nil {
 		klog.Errorf("containerdPush error: %v", err)
-		return err
+		return "", err
 	}
 
 	img, err := r.ContainerdClient.ImageService().Get(ctx, pushRef)
 	if err != nil {
-		return err
+		return "", err
 	}
 	refSpec, err := reference.Parse(pushRef)
 	if err != nil {
-		return err
+		return "", err
 	}
 	signRef := fmt.Sprintf("%s@%s", refSpec.String(), img.Target.Digest.String())
 	if err = signutil.Sign(signRef, options.GOptions.Experimental, options.SignOptions); err != nil {
-		return err
+		return "", err
 	}
 
 	klog.Infof("containerdPush success: %s", named.Name())
 
-	return nil
+	return img.Target.Digest.String(), nil
 }
 
 func (r *Containerd) Save(ctx context.Context, imageName, outputPath string) error {
+	// Create or open the output file
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+
+	// Export the image and its layers as a docker/oci compatible archive
+	options := types.ImageSaveOptions{
+		Stdout: file,
+	}
+	err = image.Save(ctx, r.ContainerdClient, []string{imageName}, options)
+	if err != nil {
+		// do not leave a truncated archive behind on the host path
+		_ = os.Remove(outputPath)
+		return fmt.Errorf("failed to save image: %w", err)
+	}
+
+	if err = file.Sync(); err != nil {
+		_ = os.Remove(outputPath)
+		return fmt.Errorf("failed to write image to file: %w", err)
+	}
+
+	klog.Infof("containerdSave success: %s saved to %s", imageName, outputPath)
 	return nil
 }
 
-func NewHostOptions(Username, Password string) (*dockerconfig.HostOptions, error) {
+func (r *Containerd) ExportRootfs(ctx context.Context, imageName, outputPath string) error {
+	named, err := refdocker.ParseDockerRef(imageName)
+	if err != nil {
+		return err
+	}
+	img, err := r.ContainerdClient.GetImage(ctx, named.String())
+	if err != nil {
+		return err
+	}
+	cs := r.ContainerdClient.ContentStore()
+	manifest, err := images.Manifest(ctx, cs, img.Target(), img.Platform())
+	if err != nil {
+		return err
+	}
+	var layers []layerOpener
+	for _, layer := range manifest.Layers {
+		layer := layer
+		layers = append(layers, func() (io.ReadCloser, error) {
+			return openLayer(ctx, cs, layer)
+		})
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+	// the whiteouts are applied, there is no lower layer left for them
+	if err = squashLayers(layers, file, false); err != nil {
+		_ = os.Remove(outputPath)
+		return fmt.Errorf("failed to export rootfs: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		_ = os.Remove(outputPath)
+		return fmt.Errorf("failed to write rootfs to file: %w", err)
+	}
+
+	klog.Infof("containerdExportRootfs success: %s exported to %s", imageName, outputPath)
+	return nil
+}
+
+func (r *Containerd) Inspect(ctx context.Context, rawRef string) (*v1.ImageStatus, error) {
+	named, err := refdocker.ParseDockerRef(rawRef)
+	if err != nil {
+		return nil, err
+	}
+	img, err := r.ContainerdClient.GetImage(ctx, named.String())
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := images.Manifest(ctx, r.ContainerdClient.ContentStore(), img.Target(), img.Platform())
+	if err != nil {
+		return nil, err
+	}
+
+	status := &v1.ImageStatus{
+		Reference:    named.String(),
+		Digest:       img.Target().Digest.String(),
+		ConfigDigest: manifest.Config.Digest.String(),
+		Size:         manifest.Config.Size,
+		Layers:       len(manifest.Layers),
+	}
+	for _, layer := range manifest.Layers {
+		status.Size += layer.Size
+	}
+	// the top layer, the committed one unless addFiles or squash changed the layers after the commit
+	if len(manifest.Layers) > 0 {
+		status.NewLayerSize = manifest.Layers[len(manifest.Layers)-1].Size
+	}
+	return status, nil
+}
+
+// containerdFIFODir holds the fifos of the exec streams, the default directory of cio.
+const containerdFIFODir = "/run/containerd/fifo"
+
+func (r *Containerd) Exec(ctx context.Context, containerID string, command []string) (string, error) {
+	c, err := r.ContainerdClient.LoadContainer(ctx, containerID)
+	if err != nil {
+		return "", containerNotFound(containerID, err)
+	}
+	task, err := c.Task(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	spec, err := c.Spec(ctx)
+	if err != nil {
+		return "", err
+	}
+	pspec := *spec.Process
+	pspec.Args = command
+	pspec.Terminal = false
+
+	output := &execOutput{}
+	execID := fmt.Sprintf("imagebuilder-%d", time.Now().UnixNano())
+	process, err := task.Exec(ctx, execID, &pspec, cio.NewCreator(cio.WithStreams(nil, output, output), cio.WithFIFODir(containerdFIFODir)))
+	if err != nil {
+		return "", err
+	}
+	// the process must be cleaned up also when ctx expired
+	defer process.Delete(context.Background(), containerd.WithProcessKill)
+	statusC, err := process.Wait(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err = process.Start(ctx); err != nil {
+		return "", err
+	}
+	select {
+	case status := <-statusC:
+		code, _, err := status.Result()
+		if err != nil {
+			return output.String(), err
+		}
+		process.IO().Wait()
+		if code != 0 {
+			return output.String(), &ExecError{ExitCode: int(code)}
+		}
+		return output.String(), nil
+	case <-ctx.Done():
+		return output.String(), ctx.Err()
+	}
+}
+
+func (r *Containerd) Resume(ctx context.Context, containerID string) (bool, error) {
+	c, err := r.ContainerdClient.LoadContainer(ctx, containerID)
+	if err != nil {
+		return false, containerNotFound(containerID, err)
+	}
+	task, err := c.Task(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	status, err := task.Status(ctx)
+	if err != nil {
+		return false, err
+	}
+	if status.Status != containerd.Paused && status.Status != containerd.Pausing {
+		return false, nil
+	}
+	return true, task.Resume(ctx)
+}
+
+func NewHostOptions(pushOptions PushOptions) (*dockerconfig.HostOptions, error) {
 	var ho dockerconfig.HostOptions
-	if Username != "" {
+	if pushOptions.Username != "" {
 		ho.Credentials = func(s string) (string, string, error) {
-			klog.Infof("authCreds: %s use Username %s, Password %s", s, Username, Password)
-			return Username, Password, nil
+			klog.Infof("authCreds: use registry credentials for %s", s)
+			return pushOptions.Username, pushOptions.Password, nil
 		}
 	}
-	ho.DefaultTLS = &tls.Config{
-		InsecureSkipVerify: true,
+	// an explicit scheme also disables the http fallback containerd applies to localhost
+	ho.DefaultScheme = "https"
+	if pushOptions.TLS != nil && pushOptions.TLS.PlainHTTP {
+		ho.DefaultScheme = "http"
+		return &ho, nil
+	}
+	tlsConfig, err := pushOptions.TLS.Config()
+	if err != nil {
+		return nil, err
 	}
-	ho.DefaultScheme = "http"
-	//ho.DefaultTLS = nil
+	ho.DefaultTLS = tlsConfig
 	return &ho, nil
 }
+
+func (r *Containerd) Tag(ctx context.Context, source, target string) error {
+	sourceNamed, err := refdocker.ParseDockerRef(source)
+	if err != nil {
+		return err
+	}
+	targetNamed, err := refdocker.ParseDockerRef(target)
+	if err != nil {
+		return err
+	}
+	is := r.ContainerdClient.ImageService()
+	img, err := is.Get(ctx, sourceNamed.String())
+	if err != nil {
+		return err
+	}
+	img.Name = targetNamed.String()
+	if _, err = is.Create(ctx, img); errdefs.IsAlreadyExists(err) {
+		_, err = is.Update(ctx, img, "target")
+	}
+	return err
+}
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"strings"
+	"time"
+)
+
+// updateImage rewrites the manifest and config of the committed image ref and points ref at the
+// new manifest. The layers referenced by the new manifest must already be in the content store,
+// mutate is called with a context holding a lease on new content.
+func (r *Containerd) updateImage(ctx context.Context, ref string, mutate func(ctx context.Context, manifest *ocispec.Manifest, config *ocispec.Image) error) error {
+	ctx, done, err := r.ContainerdClient.WithLease(ctx, leases.WithRandomID(), leases.WithExpiration(time.Hour))
+	if err != nil {
+		return fmt.Errorf("failed to create lease: %w", err)
+	}
+	defer done(ctx)
+
+	is := r.ContainerdClient.ImageService()
+	cs := r.ContainerdClient.ContentStore()
+	img, err := is.Get(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	manifest := ocispec.Manifest{}
+	if err = readJSONBlob(ctx, cs, img.Target, &manifest); err != nil {
+		return fmt.Errorf("read manifest of %s: %w", ref, err)
+	}
+	config := ocispec.Image{}
+	if err = readJSONBlob(ctx, cs, manifest.Config, &config); err != nil {
+		return fmt.Errorf("read config of %s: %w", ref, err)
+	}
+	configInfo, err := cs.Info(ctx, manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	chainID := identity.ChainID(config.RootFS.DiffIDs)
+	if err = mutate(ctx, &manifest, &config); err != nil {
+		return err
+	}
+
+	// keep the gc reference of the config to the committed snapshot unless the layers changed,
+	// the snapshot of the new layers is created when the image is unpacked
+	configLabels := map[string]string{}
+	for k, v := range configInfo.Labels {
+		if identity.ChainID(config.RootFS.DiffIDs) != chainID && strings.HasPrefix(k, "containerd.io/gc.ref.snapshot.") {
+			continue
+		}
+		configLabels[k] = v
+	}
+	manifest.Config, err = writeJSONBlob(ctx, cs, manifest.Config.MediaType, config, configLabels)
+	if err != nil {
+		return fmt.Errorf("write config of %s: %w", ref, err)
+	}
+	labels := map[string]string{"containerd.io/gc.ref.content.0": manifest.Config.Digest.String()}
+	for i, layer := range manifest.Layers {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i+1)] = layer.Digest.String()
+	}
+	img.Target, err = writeJSONBlob(ctx, cs, img.Target.MediaType, manifest, labels)
+	if err != nil {
+		return fmt.Errorf("write manifest of %s: %w", ref, err)
+	}
+	_, err = is.Update(ctx, img, "target")
+	return err
+}
+
+// layerMediaType is the media type of a gzip layer in manifest.
+func layerMediaType(manifest *ocispec.Manifest) string {
+	if manifest.MediaType == ocispec.MediaTypeImageManifest {
+		return ocispec.MediaTypeImageLayerGzip
+	}
+	return images.MediaTypeDockerSchema2LayerGzip
+}
+
+// openLayer opens the uncompressed content of layer.
+func openLayer(ctx context.Context, cs content.Store, layer ocispec.Descriptor) (io.ReadCloser, error) {
+	ra, err := cs.ReaderAt(ctx, layer)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		ra.Close()
+		return nil, err
+	}
+	return &layerReader{DecompressReadCloser: rc, ra: ra}, nil
+}
+
+type layerReader struct {
+	compression.DecompressReadCloser
+	ra content.ReaderAt
+}
+
+func (l *layerReader) Close() error {
+	l.DecompressReadCloser.Close()
+	return l.ra.Close()
+}
+
+// writeLayer gzips the uncompressed layer produced by write into the content store and returns its
+// descriptor and diff ID. When write returns false the layer is discarded and an empty descriptor
+// is returned.
+func writeLayer(ctx context.Context, cs content.Store, mediaType string, write func(w io.Writer) (bool, error)) (ocispec.Descriptor, digest.Digest, error) {
+	ref := fmt.Sprintf("imagebuilder-layer-%d", time.Now().UnixNano())
+	w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer w.Close()
+
+	compressed := &countingWriter{w: w}
+	uncompressed := digest.SHA256.Digester()
+	gz := gzip.NewWriter(compressed)
+	keep, err := write(io.MultiWriter(gz, uncompressed.Hash()))
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil || !keep {
+		_ = cs.Abort(ctx, ref)
+		return ocispec.Descriptor{}, "", err
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    w.Digest(),
+		Size:      compressed.n,
+	}
+	diffID := uncompressed.Digest()
+	labels := map[string]string{"containerd.io/uncompressed": diffID.String()}
+	err = w.Commit(ctx, desc.Size, desc.Digest, content.WithLabels(labels))
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, "", err
+	}
+	return desc, diffID, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func readJSONBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor, v interface{}) error {
+	data, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSONBlob(ctx context.Context, cs content.Store, mediaType string, v interface{}, labels map[string]string) (ocispec.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	err = content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(data), desc, content.WithLabels(labels))
+	return desc, err
+}
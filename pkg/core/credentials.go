@@ -0,0 +1,88 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+type dockerConfigEntry struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// RegistryHost returns the registry host of an image reference, e.g. docker.io for "nginx:latest".
+func RegistryHost(rawRef string) (string, error) {
+	named, err := refdocker.ParseDockerRef(rawRef)
+	if err != nil {
+		return "", err
+	}
+	return refdocker.Domain(named), nil
+}
+
+// CredentialsFromSecret returns the username and password stored in a kubernetes.io/basic-auth,
+// kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg secret for the given registry host.
+// found is false when a docker config secret has no entry for the host.
+func CredentialsFromSecret(secret *corev1.Secret, host string) (username, password string, found bool, err error) {
+	switch secret.Type {
+	case corev1.SecretTypeBasicAuth:
+		return string(secret.Data[corev1.BasicAuthUsernameKey]), string(secret.Data[corev1.BasicAuthPasswordKey]), true, nil
+	case corev1.SecretTypeDockerConfigJson:
+		cfg := dockerConfigJSON{}
+		if err = json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &cfg); err != nil {
+			return "", "", false, fmt.Errorf("secret %s/%s: invalid %s", secret.Namespace, secret.Name, corev1.DockerConfigJsonKey)
+		}
+		return lookupDockerConfig(cfg.Auths, host)
+	case corev1.SecretTypeDockercfg:
+		auths := map[string]dockerConfigEntry{}
+		if err = json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return "", "", false, fmt.Errorf("secret %s/%s: invalid %s", secret.Namespace, secret.Name, corev1.DockerConfigKey)
+		}
+		return lookupDockerConfig(auths, host)
+	default:
+		return "", "", false, fmt.Errorf("secret %s/%s has unsupported type %s", secret.Namespace, secret.Name, secret.Type)
+	}
+}
+
+func lookupDockerConfig(auths map[string]dockerConfigEntry, host string) (string, string, bool, error) {
+	host = normalizeRegistryHost(host)
+	for key, entry := range auths {
+		if normalizeRegistryHost(key) != host {
+			continue
+		}
+		if entry.Username == "" && entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return "", "", false, fmt.Errorf("invalid auth field for registry %s", key)
+			}
+			user, pwd, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return "", "", false, fmt.Errorf("invalid auth field for registry %s", key)
+			}
+			return user, pwd, true, nil
+		}
+		return entry.Username, entry.Password, true, nil
+	}
+	return "", "", false, nil
+}
+
+// normalizeRegistryHost strips the scheme and path of a docker config key and folds the
+// docker hub aliases into docker.io.
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestNormalizeRegistryHost(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "docker.io", want: "docker.io"},
+		{in: "index.docker.io", want: "docker.io"},
+		{in: "registry-1.docker.io", want: "docker.io"},
+		{in: "https://index.docker.io/v1/", want: "docker.io"},
+		{in: "http://index.docker.io/v1/", want: "docker.io"},
+		{in: "registry.example.com", want: "registry.example.com"},
+		{in: "registry.example.com:5000", want: "registry.example.com:5000"},
+		{in: "https://registry.example.com:5000/v2/", want: "registry.example.com:5000"},
+		{in: "localhost:5000", want: "localhost:5000"},
+	}
+	for _, tt := range tests {
+		if got := normalizeRegistryHost(tt.in); got != tt.want {
+			t.Errorf("normalizeRegistryHost(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLookupDockerConfig(t *testing.T) {
+	auth := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name         string
+		auths        map[string]dockerConfigEntry
+		host         string
+		wantUsername string
+		wantPassword string
+		wantFound    bool
+		wantErr      bool
+	}{
+		{
+			name:         "docker hub legacy key",
+			auths:        map[string]dockerConfigEntry{"https://index.docker.io/v1/": {Username: "hub", Password: "p"}},
+			host:         "docker.io",
+			wantUsername: "hub", wantPassword: "p", wantFound: true,
+		},
+		{
+			name:         "docker hub alias key",
+			auths:        map[string]dockerConfigEntry{"index.docker.io": {Username: "hub", Password: "p"}},
+			host:         "docker.io",
+			wantUsername: "hub", wantPassword: "p", wantFound: true,
+		},
+		{
+			name:         "docker.io key",
+			auths:        map[string]dockerConfigEntry{"docker.io": {Auth: auth("hub:p:with:colons")}},
+			host:         "docker.io",
+			wantUsername: "hub", wantPassword: "p:with:colons", wantFound: true,
+		},
+		{
+			name: "host with port",
+			auths: map[string]dockerConfigEntry{
+				"registry.example.com":      {Username: "no-port", Password: "p1"},
+				"registry.example.com:5000": {Username: "port", Password: "p2"},
+			},
+			host:         "registry.example.com:5000",
+			wantUsername: "port", wantPassword: "p2", wantFound: true,
+		},
+		{
+			name:      "port does not match the plain host",
+			auths:     map[string]dockerConfigEntry{"registry.example.com:5000": {Username: "port", Password: "p"}},
+			host:      "registry.example.com",
+			wantFound: false,
+		},
+		{
+			name:         "key with scheme and path",
+			auths:        map[string]dockerConfigEntry{"https://registry.example.com/v2/": {Username: "u", Password: "p"}},
+			host:         "registry.example.com",
+			wantUsername: "u", wantPassword: "p", wantFound: true,
+		},
+		{
+			name:         "username wins over auth",
+			auths:        map[string]dockerConfigEntry{"registry.example.com": {Username: "u", Password: "p", Auth: auth("other:x")}},
+			host:         "registry.example.com",
+			wantUsername: "u", wantPassword: "p", wantFound: true,
+		},
+		{
+			name:      "missing entry",
+			auths:     map[string]dockerConfigEntry{"docker.io": {Username: "hub", Password: "p"}},
+			host:      "registry.example.com",
+			wantFound: false,
+		},
+		{
+			name:    "auth not base64",
+			auths:   map[string]dockerConfigEntry{"registry.example.com": {Auth: "%%%"}},
+			host:    "registry.example.com",
+			wantErr: true,
+		},
+		{
+			name:    "auth without colon",
+			auths:   map[string]dockerConfigEntry{"registry.example.com": {Auth: auth("user")}},
+			host:    "registry.example.com",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, password, found, err := lookupDockerConfig(tt.auths, tt.host)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("lookupDockerConfig() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != tt.wantUsername || password != tt.wantPassword || found != tt.wantFound {
+				t.Errorf("lookupDockerConfig() = %q, %q, %v, want %q, %q, %v",
+					username, password, found, tt.wantUsername, tt.wantPassword, tt.wantFound)
+			}
+		})
+	}
+}
@@ -7,9 +7,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	refdocker "github.com/containerd/containerd/reference/docker"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/registry"
 	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	v1 "imagebuilder/api/v1"
 	"io"
+	"k8s.io/klog/v2"
+	"net"
 	"os"
 	"strings"
 )
@@ -18,15 +27,122 @@ type Docker struct {
 	DockerClient *dockerclient.Client
 }
 
-func (r *Docker) Commit(ctx context.Context, containerID, to string) error {
+func (r *Docker) Commit(ctx context.Context, containerID, to string, commitOptions CommitOptions) error {
 
 	opts := types.ContainerCommitOptions{
 		Reference: to,
-		Pause:     true,
+		Pause:     commitOptions.Pause,
+		Changes:   commitOptions.Changes,
+		Author:    commitOptions.Author,
+		Comment:   commitOptions.Message,
 	}
-	_, err := r.DockerClient.ContainerCommit(ctx, containerID, opts)
+	committed, err := r.DockerClient.ContainerCommit(ctx, containerID, opts)
+	if err != nil {
+		return containerNotFound(containerID, err)
+	}
+
+	// docker merges the container env into any env given with the commit, so it is filtered
+	// in the committed image
+	base := r.baseImage(ctx, containerID)
+	edit := dockerImageEdit{
+		config: func(config *ocispec.Image) error {
+			return commitOptions.updateConfig(&config.Config, imageConfig(base), true)
+		},
+	}
+	exclude := excludeMatcher(commitOptions.ExcludePaths)
+	if len(commitOptions.ExcludePaths) > 0 && r.changesExcluded(ctx, containerID, exclude) {
+		edit.topLayer = func(r io.Reader, w io.Writer) error {
+			excluded, err := filterLayer(r, w, exclude)
+			klog.Infof("excluded %d entries from the committed layer", excluded)
+			return err
+		}
+	}
+	if len(commitOptions.AddFiles) > 0 {
+		edit.appendLayer = func(w io.Writer) error {
+			return writeFilesLayer(w, commitOptions.AddFiles)
+		}
+		edit.appendHistory = addFilesHistory(commitOptions.AddFiles)
+	}
+	if commitOptions.Squash != "" {
+		edit.squashFrom = func(diffIDs []digest.Digest) (int, error) {
+			return squashFrom(commitOptions.Squash, base, diffIDs)
+		}
+		edit.squashHistory = squashHistoryEntry(commitOptions.Squash)
+	}
+	err = r.updateImage(ctx, to, edit)
+	if err != nil {
+		return fmt.Errorf("update image config: %w", err)
+	}
+	r.removeReplacedImage(ctx, to, committed.ID)
+	return nil
+}
+
+// changesExcluded tells whether a file changed in the container matches exclude, the committed
+// layer is only rewritten then. Deletions are whiteouts, which are never excluded. The diff is
+// taken after the commit, it can only report more changes than the layer holds.
+func (r *Docker) changesExcluded(ctx context.Context, containerID string, exclude func(name string) bool) bool {
+	changes, err := r.DockerClient.ContainerDiff(ctx, containerID)
+	if err != nil {
+		klog.Warningf("diff container %s, filter the committed layer: %v", containerID, err)
+		return true
+	}
+	return matchChanges(changes, exclude)
+}
 
-	return err
+func matchChanges(changes []container.FilesystemChange, exclude func(name string) bool) bool {
+	for _, change := range changes {
+		if change.Kind != container.ChangeDelete && exclude(change.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeReplacedImage removes the committed image id once the rewritten image was loaded as ref,
+// it is left untagged otherwise.
+func (r *Docker) removeReplacedImage(ctx context.Context, ref, id string) {
+	img, _, err := r.DockerClient.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		klog.Warningf("inspect image %s: %v", ref, err)
+		return
+	}
+	if img.ID == id {
+		return
+	}
+	// the parents are the image of the container, they are not pruned
+	_, err = r.DockerClient.ImageRemove(ctx, id, types.ImageRemoveOptions{})
+	if err != nil && !dockerclient.IsErrNotFound(err) {
+		klog.Warningf("remove replaced image %s of %s: %v", id, ref, err)
+	}
+}
+
+// baseImage returns the image the container was created from, nil if it is unknown. Only the
+// fields used by the commit options are set.
+func (r *Docker) baseImage(ctx context.Context, containerID string) *ocispec.Image {
+	c, err := r.DockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		klog.Warningf("inspect container %s: %v", containerID, err)
+		return nil
+	}
+	img, _, err := r.DockerClient.ImageInspectWithRaw(ctx, c.Image)
+	if err != nil {
+		klog.Warningf("inspect image %s: %v", c.Image, err)
+		return nil
+	}
+	base := &ocispec.Image{RootFS: ocispec.RootFS{Type: img.RootFS.Type}}
+	for _, layer := range img.RootFS.Layers {
+		base.RootFS.DiffIDs = append(base.RootFS.DiffIDs, digest.Digest(layer))
+	}
+	if img.Config != nil {
+		base.Config = ocispec.ImageConfig{
+			User:       img.Config.User,
+			Env:        img.Config.Env,
+			Entrypoint: img.Config.Entrypoint,
+			Cmd:        img.Config.Cmd,
+			WorkingDir: img.Config.WorkingDir,
+		}
+	}
+	return base
 }
 
 type AuthConfig struct {
@@ -34,47 +150,123 @@ type AuthConfig struct {
 	Password string
 }
 
-func (r *Docker) Push(ctx context.Context, imageName, Username, Password string) error {
+type pushMessage struct {
+	Error string `json:"error,omitempty"`
+	Aux   struct {
+		Digest string `json:"Digest,omitempty"`
+	} `json:"aux,omitempty"`
+}
 
-	authConfig := AuthConfig{Username: Username, Password: Password}
+// CheckDockerTLS rejects the registry certificates of the push destinations of spec, docker
+// pushes with the certificates configured in the daemon only. It is checked before the commit.
+func CheckDockerTLS(spec *v1.ImageBuilderSpec) error {
+	if !spec.HasOperation(v1.Push) {
+		return nil
+	}
+	for _, destination := range spec.PushDestinations() {
+		if tls := destination.TLS; tls != nil && (tls.CA != nil || tls.ClientCertSecretRef != nil) {
+			return fmt.Errorf("destination %s: tls.ca and tls.clientCertSecretRef are not supported with docker, "+
+				"an administrator must configure the certificates of the registry in /etc/docker/certs.d on the nodes", destination.To)
+		}
+	}
+	return nil
+}
+
+func (r *Docker) Push(ctx context.Context, imageName string, pushOptions PushOptions) (string, error) {
+
+	authConfig := AuthConfig{Username: pushOptions.Username, Password: pushOptions.Password}
 	authBytes, _ := json.Marshal(authConfig)
 	encodedAuth := base64.StdEncoding.EncodeToString(authBytes)
 
 	var opts types.ImagePushOptions
-	if Username != "" {
+	if pushOptions.Username != "" {
 		opts.RegistryAuth = encodedAuth
 	}
+	host, err := RegistryHost(imageName)
+	if err != nil {
+		return "", err
+	}
+	if err = r.checkInsecureRegistry(ctx, host, pushOptions.TLS); err != nil {
+		return "", err
+	}
+	if tls := pushOptions.TLS; tls != nil && (len(tls.CA) > 0 || len(tls.ClientCert) > 0) {
+		// the daemon trust is shared by the node, it is not changed on behalf of an ImageBuilder
+		return "", fmt.Errorf("tls.ca and tls.clientCertSecretRef are not supported with docker, "+
+			"an administrator must configure the certificates of registry %s in /etc/docker/certs.d/%s on the nodes", host, host)
+	}
 
 	out, err := r.DockerClient.ImagePush(ctx, imageName, opts)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer out.Close()
 
 	scanner := bufio.NewScanner(out)
 	//{"errorDetail":{"message":"received unexpected HTTP status: 504 Gateway Time-out"},"error":"received unexpected HTTP status: 504 Gateway Time-out"}
+	//{"progressDetail":{},"aux":{"Tag":"4.1","Digest":"sha256:...","Size":1570}}
 
+	var digest string
 	for scanner.Scan() {
 		str := scanner.Text()
 		fmt.Println(str)
-		if strings.Contains(str, "error") {
-			m := map[string]interface{}{}
-			err = json.Unmarshal(scanner.Bytes(), &m)
-			if err == nil {
-				if v, ok := m["error"]; ok {
-					return errors.New(v.(string))
-				}
-
-			}
+		m := pushMessage{}
+		if json.Unmarshal(scanner.Bytes(), &m) != nil {
+			continue
 		}
+		if m.Error != "" {
+			return "", errors.New(m.Error)
+		}
+		if m.Aux.Digest != "" {
+			digest = m.Aux.Digest
+		}
+	}
 
+	return digest, scanner.Err()
+}
+
+// checkInsecureRegistry makes docker push like containerd: the daemon accepts plain HTTP and
+// unverified certificates for its insecure-registries only, so a destination must be insecure
+// exactly when the daemon treats its registry as insecure.
+func (r *Docker) checkInsecureRegistry(ctx context.Context, host string, registryTLS *RegistryTLS) error {
+	info, err := r.DockerClient.Info(ctx)
+	if err != nil {
+		return err
 	}
+	insecure := daemonInsecureRegistry(info.RegistryConfig, host)
+	switch {
+	case registryTLS.Insecure() && !insecure:
+		return fmt.Errorf("registry %s is not in the insecure-registries of the docker daemon, plainHTTP and insecureSkipVerify require it", host)
+	case !registryTLS.Insecure() && insecure:
+		return fmt.Errorf("the docker daemon treats registry %s as insecure, set tls.insecureSkipVerify or tls.plainHTTP of the destination to push to it", host)
+	}
+	return nil
+}
 
-	//_, err = io.Copy(os.Stdout, out)
-	//if err != nil {
-	//	return err
-	//}
-	defer out.Close()
-	return err
+func daemonInsecureRegistry(config *registry.ServiceConfig, host string) bool {
+	if config == nil {
+		return false
+	}
+	if index, ok := config.IndexConfigs[host]; ok {
+		return !index.Secure
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	ip := net.ParseIP(hostname)
+	if hostname == "localhost" {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	for _, cidr := range config.InsecureRegistryCIDRs {
+		if ip != nil && (*net.IPNet)(cidr).Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Docker) Tag(ctx context.Context, source, target string) error {
+	return r.DockerClient.ImageTag(ctx, source, target)
 }
 
 func (r *Docker) Save(ctx context.Context, imageName, outputPath string) error {
@@ -101,3 +293,123 @@ func (r *Docker) Save(ctx context.Context, imageName, outputPath string) error {
 	fmt.Printf("Image saved to %s\n", outputPath)
 	return nil
 }
+
+func (r *Docker) Exec(ctx context.Context, containerID string, command []string) (string, error) {
+	exec, err := r.DockerClient.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          command,
+	})
+	if err != nil {
+		return "", containerNotFound(containerID, err)
+	}
+	resp, err := r.DockerClient.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+
+	output := &execOutput{}
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(output, output, resp.Reader)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			return output.String(), err
+		}
+	case <-ctx.Done():
+		return output.String(), ctx.Err()
+	}
+
+	inspect, err := r.DockerClient.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return output.String(), err
+	}
+	if inspect.ExitCode != 0 {
+		return output.String(), &ExecError{ExitCode: inspect.ExitCode}
+	}
+	return output.String(), nil
+}
+
+func (r *Docker) Resume(ctx context.Context, containerID string) (bool, error) {
+	inspect, err := r.DockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return false, containerNotFound(containerID, err)
+	}
+	if inspect.State == nil || !inspect.State.Paused {
+		return false, nil
+	}
+	return true, r.DockerClient.ContainerUnpause(ctx, containerID)
+}
+
+func (r *Docker) ExportRootfs(ctx context.Context, imageName, outputPath string) error {
+	// docker only exports containers, the one created from the image is never started
+	created, err := r.DockerClient.ContainerCreate(ctx, &container.Config{
+		Image:      imageName,
+		Entrypoint: []string{"true"},
+	}, nil, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to create container of %s: %w", imageName, err)
+	}
+	defer func() {
+		err := r.DockerClient.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			klog.Warningf("remove export container %s error: %v", created.ID, err)
+		}
+	}()
+
+	reader, err := r.DockerClient.ContainerExport(ctx, created.ID)
+	if err != nil {
+		return fmt.Errorf("failed to export rootfs: %w", err)
+	}
+	defer reader.Close()
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+	if _, err = io.Copy(file, reader); err != nil {
+		_ = os.Remove(outputPath)
+		return fmt.Errorf("failed to write rootfs to file: %w", err)
+	}
+
+	klog.Infof("dockerExportRootfs success: %s exported to %s", imageName, outputPath)
+	return nil
+}
+
+func (r *Docker) Inspect(ctx context.Context, imageName string) (*v1.ImageStatus, error) {
+	named, err := refdocker.ParseDockerRef(imageName)
+	if err != nil {
+		return nil, err
+	}
+	inspect, _, err := r.DockerClient.ImageInspectWithRaw(ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+	history, err := r.DockerClient.ImageHistory(ctx, inspect.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &v1.ImageStatus{
+		Reference:    named.String(),
+		ConfigDigest: inspect.ID,
+		Size:         inspect.Size,
+		Layers:       len(inspect.RootFS.Layers),
+	}
+	// the manifest digest is only known once the image has been pushed
+	for _, repoDigest := range inspect.RepoDigests {
+		if name, digest, ok := strings.Cut(repoDigest, "@"); ok && name == refdocker.FamiliarName(named) {
+			status.Digest = digest
+		}
+	}
+	// history is ordered from the newest layer, the top layer reported as NewLayerSize
+	if len(history) > 0 {
+		status.NewLayerSize = history[0].Size
+	}
+	return status, nil
+}
@@ -0,0 +1,559 @@
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// dockerManifest is an entry of the manifest.json written by docker save.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// maxArchiveMetadataSize bounds the files of a docker save archive kept in memory, configs and
+// manifests are small while layers are not.
+const maxArchiveMetadataSize = 1 << 20
+
+// archiveMetadataFiles are replaced when an archive is loaded again. Without index.json docker
+// falls back to manifest.json for both the classic and the containerd image store.
+var archiveMetadataFiles = map[string]bool{
+	"manifest.json": true,
+	"index.json":    true,
+	"oci-layout":    true,
+	"repositories":  true,
+}
+
+// dockerImageEdit describes how updateImage rewrites an image.
+type dockerImageEdit struct {
+	// config is applied to the image config.
+	config func(config *ocispec.Image) error
+	// topLayer copies the uncompressed last layer from r to w with its changes, nil keeps the layer.
+	topLayer func(r io.Reader, w io.Writer) error
+	// appendLayer writes an uncompressed layer added on top of the image, nil adds none.
+	appendLayer func(w io.Writer) error
+	// appendHistory describes the appended layer in the image history.
+	appendHistory ocispec.History
+	// squashFrom returns the first layer merged with all layers above it, including the appended
+	// one, into a single layer. nil squashes nothing.
+	squashFrom    func(diffIDs []digest.Digest) (int, error)
+	squashHistory ocispec.History
+}
+
+// updateImage rewrites the image ref. The docker API cannot modify an image, so it is saved,
+// rewritten while streaming and loaded again under the same tag. Layer edits need the manifest
+// up front and read the archive once more before.
+func (r *Docker) updateImage(ctx context.Context, ref string, edit dockerImageEdit) error {
+	if edit.topLayer == nil && edit.appendLayer == nil && edit.squashFrom == nil {
+		return r.updateImageConfig(ctx, ref, edit.config)
+	}
+	manifest, rawConfig, err := r.readArchive(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	config := ocispec.Image{}
+	if err = json.Unmarshal(rawConfig, &config); err != nil {
+		return fmt.Errorf("read config of %s: %w", ref, err)
+	}
+	if edit.config != nil {
+		if err = edit.config(&config); err != nil {
+			return err
+		}
+	}
+
+	top := -1
+	if len(manifest.Layers) > 0 && len(manifest.Layers) == len(config.RootFS.DiffIDs) && edit.topLayer != nil {
+		top = len(manifest.Layers) - 1
+	}
+	squashFrom := len(manifest.Layers)
+	if edit.squashFrom != nil {
+		from, err := edit.squashFrom(config.RootFS.DiffIDs)
+		if err != nil {
+			return err
+		}
+		squashed := len(manifest.Layers) - from
+		if edit.appendLayer != nil {
+			squashed++
+		}
+		if squashed > 1 {
+			squashFrom = from
+		}
+	}
+	blobs := len(manifest.Layers) > 0 && strings.HasPrefix(manifest.Layers[0], "blobs/")
+
+	// the layers to squash are buffered in temp files, they are read twice and in order
+	spooled := map[string]string{}
+	var tempFiles []string
+	defer func() {
+		for _, name := range tempFiles {
+			os.Remove(name)
+		}
+	}()
+
+	replace := func(hdr *tar.Header, tr io.Reader, tw *tar.Writer) (bool, error) {
+		isTop, isBase, isSquashed := false, false, false
+		for i, name := range manifest.Layers {
+			if name == hdr.Name {
+				isTop = isTop || i == top
+				isBase = isBase || i < squashFrom
+				isSquashed = isSquashed || i >= squashFrom
+			}
+		}
+		switch {
+		case isSquashed:
+			file, err := spoolFile(tr)
+			if err != nil {
+				return true, err
+			}
+			spooled[hdr.Name] = file
+			tempFiles = append(tempFiles, file)
+			if isBase {
+				// the same layer is used below the squashed ones
+				return true, copyFileEntry(tw, hdr, file)
+			}
+			return true, nil
+		case isTop:
+			name, diffID, err := writeArchiveLayer(tw, blobs, func(w io.Writer) error {
+				return edit.topLayer(tr, w)
+			})
+			if err != nil {
+				return true, fmt.Errorf("rewrite layer %s: %w", hdr.Name, err)
+			}
+			manifest.Layers[top] = name
+			config.RootFS.DiffIDs[top] = diffID
+			return true, nil
+		}
+		return false, nil
+	}
+
+	return r.loadArchive(ctx, ref, replace, func(tw *tar.Writer, _ []byte) error {
+		var layers []layerOpener
+		for i := squashFrom; i < len(manifest.Layers); i++ {
+			file, ok := spooled[manifest.Layers[i]]
+			if !ok {
+				return fmt.Errorf("layer %s not found in archive", manifest.Layers[i])
+			}
+			layers = append(layers, fileLayer(file, i == top, edit.topLayer))
+		}
+
+		if edit.appendLayer != nil {
+			if squashFrom < len(manifest.Layers) {
+				file, err := spoolLayer(edit.appendLayer)
+				if err != nil {
+					return fmt.Errorf("append layer: %w", err)
+				}
+				tempFiles = append(tempFiles, file)
+				layers = append(layers, fileLayer(file, false, nil))
+			} else {
+				name, diffID, err := writeArchiveLayer(tw, blobs, edit.appendLayer)
+				if err != nil {
+					return fmt.Errorf("append layer: %w", err)
+				}
+				manifest.Layers = append(manifest.Layers, name)
+				config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+			}
+			config.History = append(config.History, edit.appendHistory)
+		}
+
+		if len(layers) > 0 {
+			name, diffID, err := writeArchiveLayer(tw, blobs, func(w io.Writer) error {
+				return squashLayers(layers, w, squashFrom > 0)
+			})
+			if err != nil {
+				return fmt.Errorf("squash layers: %w", err)
+			}
+			manifest.Layers = append(manifest.Layers[:squashFrom:squashFrom], name)
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs[:squashFrom:squashFrom], diffID)
+			config.History = squashHistory(config.History, squashFrom, edit.squashHistory)
+		}
+
+		return writeArchiveConfig(tw, manifest, rawConfig, &config)
+	})
+}
+
+// updateImageConfig applies edit to the config of ref in a single save and load, the config and
+// manifest are picked up while the archive streams by. The config is checked against the image
+// inspect first, nothing is loaded when it is unchanged.
+func (r *Docker) updateImageConfig(ctx context.Context, ref string, edit func(config *ocispec.Image) error) error {
+	if edit == nil {
+		return nil
+	}
+	inspect, _, err := r.DockerClient.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("inspect image %s: %w", ref, err)
+	}
+	// the docker config uses the json names of the OCI image config
+	config := ocispec.Image{}
+	if inspect.Config != nil {
+		raw, err := json.Marshal(inspect.Config)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(raw, &config.Config); err != nil {
+			return err
+		}
+	}
+	before, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err = edit(&config); err != nil {
+		return err
+	}
+	after, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(before, after) {
+		return nil
+	}
+
+	// configs are json, layers are tars, so only json files are kept to find the config later
+	files := map[string][]byte{}
+	replace := func(hdr *tar.Header, tr io.Reader, tw *tar.Writer) (bool, error) {
+		if hdr.Typeflag != tar.TypeReg || hdr.Size > maxArchiveMetadataSize {
+			return false, nil
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return true, err
+		}
+		if bytes.HasPrefix(data, []byte("{")) {
+			files[hdr.Name] = data
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return true, err
+		}
+		_, err = tw.Write(data)
+		return true, err
+	}
+	return r.loadArchive(ctx, ref, replace, func(tw *tar.Writer, rawManifest []byte) error {
+		var manifests []dockerManifest
+		if err := json.Unmarshal(rawManifest, &manifests); err != nil {
+			return fmt.Errorf("read manifest.json of %s: %w", ref, err)
+		}
+		if len(manifests) != 1 {
+			return fmt.Errorf("expected one image in the archive of %s, found %d", ref, len(manifests))
+		}
+		rawConfig, ok := files[manifests[0].Config]
+		if !ok {
+			return fmt.Errorf("config %s of %s not found in archive", manifests[0].Config, ref)
+		}
+		config := ocispec.Image{}
+		if err := json.Unmarshal(rawConfig, &config); err != nil {
+			return fmt.Errorf("read config of %s: %w", ref, err)
+		}
+		if err := edit(&config); err != nil {
+			return err
+		}
+		return writeArchiveConfig(tw, &manifests[0], rawConfig, &config)
+	})
+}
+
+// writeArchiveConfig adds config, merged into the original rawConfig, and the manifest pointing
+// to it to tw.
+func writeArchiveConfig(tw *tar.Writer, manifest *dockerManifest, rawConfig []byte, config *ocispec.Image) error {
+	updated, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	// docker configs carry fields unknown to the OCI spec, e.g. the healthcheck, keep them
+	rawConfig, err = mergeConfig(rawConfig, updated)
+	if err != nil {
+		return err
+	}
+	manifest.Config = digest.FromBytes(rawConfig).Encoded() + ".json"
+	rawManifest, err := json.Marshal([]dockerManifest{*manifest})
+	if err != nil {
+		return err
+	}
+	if err = writeTarFile(tw, manifest.Config, rawConfig); err != nil {
+		return err
+	}
+	return writeTarFile(tw, "manifest.json", rawManifest)
+}
+
+// spoolFile copies r to a temp file and returns its name.
+func spoolFile(r io.Reader) (string, error) {
+	return spoolLayer(func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// spoolLayer writes the layer produced by write to a temp file and returns its name.
+func spoolLayer(write func(w io.Writer) error) (string, error) {
+	tmp, err := os.CreateTemp("", "layer-*.tar")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if err = write(tmp); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// fileLayer opens the layer in file, rewritten by rewrite when isTop is set.
+func fileLayer(file string, isTop bool, rewrite func(r io.Reader, w io.Writer) error) layerOpener {
+	return func() (io.ReadCloser, error) {
+		f, err := os.Open(file)
+		if err != nil || !isTop {
+			return f, err
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			defer f.Close()
+			pw.CloseWithError(rewrite(f, pw))
+		}()
+		return pr, nil
+	}
+}
+
+func copyFileEntry(tw *tar.Writer, hdr *tar.Header, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// writeArchiveLayer adds the uncompressed layer produced by write to tw and returns its name and
+// diff ID. blobs names it like the containerd image store of docker does. The size of a tar entry
+// must be known up front, so the layer is buffered in a temp file.
+func writeArchiveLayer(tw *tar.Writer, blobs bool, write func(w io.Writer) error) (string, digest.Digest, error) {
+	tmp, err := os.CreateTemp("", "layer-*.tar")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digester := digest.SHA256.Digester()
+	if err = write(io.MultiWriter(tmp, digester.Hash())); err != nil {
+		return "", "", err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+
+	diffID := digester.Digest()
+	// the classic store names layers <id>/layer.tar, the containerd store blobs/sha256/<digest>
+	newName := diffID.Encoded() + "/layer.tar"
+	if blobs {
+		newName = "blobs/sha256/" + diffID.Encoded()
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     newName,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	_, err = io.Copy(tw, tmp)
+	return newName, diffID, err
+}
+
+// readArchive returns the manifest and the raw config of ref from docker save.
+func (r *Docker) readArchive(ctx context.Context, ref string) (*dockerManifest, []byte, error) {
+	reader, err := r.DockerClient.ImageSave(ctx, []string{ref})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to save image: %w", err)
+	}
+	defer reader.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size > maxArchiveMetadataSize {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		files[hdr.Name] = data
+	}
+
+	var manifests []dockerManifest
+	if err = json.Unmarshal(files["manifest.json"], &manifests); err != nil {
+		return nil, nil, fmt.Errorf("read manifest.json of %s: %w", ref, err)
+	}
+	if len(manifests) != 1 {
+		return nil, nil, fmt.Errorf("expected one image in the archive of %s, found %d", ref, len(manifests))
+	}
+	rawConfig, ok := files[manifests[0].Config]
+	if !ok {
+		return nil, nil, fmt.Errorf("config %s of %s not found in archive", manifests[0].Config, ref)
+	}
+	return &manifests[0], rawConfig, nil
+}
+
+// loadArchive streams docker save of ref into docker load. Entries handled by replace are not
+// copied, the metadata files are dropped and replaced by the files written by extra, which gets
+// the original manifest.json.
+func (r *Docker) loadArchive(ctx context.Context, ref string, replace func(hdr *tar.Header, tr io.Reader, tw *tar.Writer) (bool, error), extra func(tw *tar.Writer, rawManifest []byte) error) error {
+	reader, err := r.DockerClient.ImageSave(ctx, []string{ref})
+	if err != nil {
+		return fmt.Errorf("failed to save image: %w", err)
+	}
+	defer reader.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copyArchive(tar.NewReader(reader), tar.NewWriter(pw), replace, extra))
+	}()
+
+	resp, err := r.DockerClient.ImageLoad(ctx, pr, true)
+	if err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("failed to load image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		m := pushMessage{}
+		if json.Unmarshal(scanner.Bytes(), &m) == nil && m.Error != "" {
+			return fmt.Errorf("failed to load image: %s", m.Error)
+		}
+	}
+	return scanner.Err()
+}
+
+func copyArchive(tr *tar.Reader, tw *tar.Writer, replace func(hdr *tar.Header, tr io.Reader, tw *tar.Writer) (bool, error), extra func(tw *tar.Writer, rawManifest []byte) error) error {
+	var rawManifest []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if archiveMetadataFiles[hdr.Name] {
+			if hdr.Name == "manifest.json" && hdr.Size <= maxArchiveMetadataSize {
+				if rawManifest, err = io.ReadAll(tr); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		replaced, err := replace(hdr, tr, tw)
+		if err != nil {
+			return err
+		}
+		if replaced {
+			continue
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	if err := extra(tw, rawManifest); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// ociImageKeys and ociConfigKeys are the json fields of ocispec.Image and ocispec.ImageConfig.
+var (
+	ociImageKeys  = []string{"created", "author", "architecture", "variant", "os", "os.version", "os.features", "rootfs", "history"}
+	ociConfigKeys = []string{"User", "ExposedPorts", "Env", "Entrypoint", "Cmd", "Volumes", "WorkingDir", "Labels", "StopSignal", "ArgsEscaped"}
+)
+
+// mergeConfig replaces the OCI fields of the docker config original with the ones of updated.
+func mergeConfig(original, updated []byte) ([]byte, error) {
+	var originalImage, updatedImage map[string]json.RawMessage
+	if err := json.Unmarshal(original, &originalImage); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(updated, &updatedImage); err != nil {
+		return nil, err
+	}
+	var originalConfig, updatedConfig map[string]json.RawMessage
+	if raw, ok := originalImage["config"]; ok && !bytes.Equal(raw, []byte("null")) {
+		if err := json.Unmarshal(raw, &originalConfig); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := updatedImage["config"]; ok {
+		if err := json.Unmarshal(raw, &updatedConfig); err != nil {
+			return nil, err
+		}
+	}
+	if originalConfig == nil {
+		originalConfig = map[string]json.RawMessage{}
+	}
+
+	mergeKeys(originalImage, updatedImage, ociImageKeys)
+	mergeKeys(originalConfig, updatedConfig, ociConfigKeys)
+	config, err := json.Marshal(originalConfig)
+	if err != nil {
+		return nil, err
+	}
+	originalImage["config"] = config
+	// the container config of a commit repeats the unfiltered environment of the container
+	delete(originalImage, "container_config")
+	return json.Marshal(originalImage)
+}
+
+func mergeKeys(original, updated map[string]json.RawMessage, keys []string) {
+	for _, key := range keys {
+		if value, ok := updated[key]; ok {
+			original[key] = value
+		} else {
+			delete(original, key)
+		}
+	}
+}
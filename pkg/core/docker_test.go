@@ -0,0 +1,78 @@
+package core
+
+import (
+	"github.com/docker/docker/api/types/container"
+	v1 "imagebuilder/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func TestMatchChanges(t *testing.T) {
+	exclude := excludeMatcher(DefaultExcludePaths)
+	tests := []struct {
+		name    string
+		changes []container.FilesystemChange
+		want    bool
+	}{
+		{name: "no changes", want: false},
+		{
+			name: "only application files",
+			changes: []container.FilesystemChange{
+				{Kind: container.ChangeModify, Path: "/app"},
+				{Kind: container.ChangeAdd, Path: "/app/model.bin"},
+				{Kind: container.ChangeModify, Path: "/tmp"},
+			},
+			want: false,
+		},
+		{
+			name: "excluded file added",
+			changes: []container.FilesystemChange{
+				{Kind: container.ChangeModify, Path: "/tmp"},
+				{Kind: container.ChangeAdd, Path: "/tmp/build.log"},
+			},
+			want: true,
+		},
+		{
+			name:    "excluded file modified",
+			changes: []container.FilesystemChange{{Kind: container.ChangeModify, Path: "/root/.bash_history"}},
+			want:    true,
+		},
+		{
+			name:    "excluded file deleted",
+			changes: []container.FilesystemChange{{Kind: container.ChangeDelete, Path: "/tmp/old.log"}},
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchChanges(tt.changes, exclude); got != tt.want {
+				t.Errorf("matchChanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDockerTLS(t *testing.T) {
+	ca := &v1.RegistryTLS{CA: &v1.CASource{}}
+	tests := []struct {
+		name    string
+		spec    v1.ImageBuilderSpec
+		wantErr bool
+	}{
+		{name: "no tls", spec: v1.ImageBuilderSpec{Operator: v1.Push, To: "registry.example.com/a:v1"}},
+		{name: "insecure registry", spec: v1.ImageBuilderSpec{Operator: v1.Push, To: "registry.local/a:v1", TLS: &v1.RegistryTLS{PlainHTTP: true}}},
+		{name: "ca of spec.tls", spec: v1.ImageBuilderSpec{Operator: v1.Push, To: "registry.example.com/a:v1", TLS: ca}, wantErr: true},
+		{name: "client certificate of a destination", spec: v1.ImageBuilderSpec{Operator: v1.Push, Destinations: []v1.Destination{
+			{To: "registry.example.com/a:v1"},
+			{To: "mirror.example.com/a:v1", TLS: &v1.RegistryTLS{ClientCertSecretRef: &corev1.LocalObjectReference{Name: "client"}}},
+		}}, wantErr: true},
+		{name: "not pushed", spec: v1.ImageBuilderSpec{Operator: v1.Save, To: "registry.example.com/a:v1", TLS: ca}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckDockerTLS(&tt.spec); (err != nil) != tt.wantErr {
+				t.Errorf("CheckDockerTLS() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"k8s.io/klog/v2"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// serviceEnv matches the variables kubelet injects for every service of the namespace, e.g.
+// KUBERNETES_SERVICE_HOST, REDIS_SERVICE_PORT_HTTP, REDIS_PORT or REDIS_PORT_6379_TCP_ADDR.
+var serviceEnv = regexp.MustCompile(`^[A-Z0-9_]+_(SERVICE_HOST|SERVICE_PORT(_[A-Z0-9_]+)?|PORT(_[0-9]+_(TCP|UDP|SCTP)(_(PROTO|PORT|ADDR))?)?)$`)
+
+// filterEnv removes the variables the runtime and the pod spec injected into the container from
+// env, the env of the committed image. imageEnv is the env of the image the container was created
+// from: a variable of it the pod overrode gets its image value back, any other variable is
+// dropped. When imageEnv is nil, the variables of the pod spec, the service variables and
+// HOSTNAME are dropped instead. Variables matching KeepEnv or set by Changes are always kept.
+// Only docker commits the env of the container. On containerd the filter is a no-op, nerdctl builds
+// the committed config from the config of the base image.
+func (o CommitOptions) filterEnv(env, imageEnv []string) []string {
+	keep := append([]string{}, o.KeepEnv...)
+	changed := ocispec.ImageConfig{}
+	if err := ApplyChanges(&changed, o.Changes); err == nil {
+		for _, kv := range changed.Env {
+			key, _, _ := strings.Cut(kv, "=")
+			keep = append(keep, key)
+		}
+	}
+
+	// the entries of the image are restored verbatim, also a KEY without =
+	image := map[string]string{}
+	for _, kv := range imageEnv {
+		key, _, _ := strings.Cut(kv, "=")
+		image[key] = kv
+	}
+	pod := map[string]bool{}
+	for _, key := range o.PodEnv {
+		pod[key] = true
+	}
+
+	var filtered, dropped []string
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		imageKV, inImage := image[key]
+		switch {
+		case matchEnv(keep, key):
+			filtered = append(filtered, kv)
+		case imageEnv != nil && inImage:
+			if kv != imageKV {
+				dropped = append(dropped, key)
+			}
+			filtered = append(filtered, imageKV)
+		case imageEnv != nil:
+			dropped = append(dropped, key)
+		case pod[key] || serviceEnv.MatchString(key) || key == "HOSTNAME":
+			dropped = append(dropped, key)
+		default:
+			filtered = append(filtered, kv)
+		}
+	}
+	if len(dropped) > 0 {
+		klog.Infof("remove injected environment variables from image: %s", strings.Join(dropped, ", "))
+	}
+	return filtered
+}
+
+func matchEnv(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
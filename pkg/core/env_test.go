@@ -0,0 +1,88 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  CommitOptions
+		env      []string
+		imageEnv []string
+		want     []string
+	}{
+		{
+			name:     "reset to the image env",
+			env:      []string{"PATH=/usr/bin", "LANG=C.UTF-8", "KUBERNETES_SERVICE_HOST=10.0.0.1", "DB_PASSWORD=secret"},
+			imageEnv: []string{"PATH=/usr/bin", "LANG=C"},
+			want:     []string{"PATH=/usr/bin", "LANG=C"},
+		},
+		{
+			name:     "empty image env drops everything",
+			env:      []string{"HOSTNAME=pod-0", "APP=1"},
+			imageEnv: []string{},
+			want:     nil,
+		},
+		{
+			name:     "keepEnv glob",
+			options:  CommitOptions{KeepEnv: []string{"APP_*", "JAVA_OPTS"}},
+			env:      []string{"PATH=/usr/bin", "APP_MODE=prod", "APP_LEVEL=2", "APPLICATION=x", "JAVA_OPTS=-Xmx1g"},
+			imageEnv: []string{"PATH=/usr/bin"},
+			want:     []string{"PATH=/usr/bin", "APP_MODE=prod", "APP_LEVEL=2", "JAVA_OPTS=-Xmx1g"},
+		},
+		{
+			name:     "keepEnv wins over the image value",
+			options:  CommitOptions{KeepEnv: []string{"LANG"}},
+			env:      []string{"LANG=C.UTF-8"},
+			imageEnv: []string{"LANG=C"},
+			want:     []string{"LANG=C.UTF-8"},
+		},
+		{
+			name:     "variables set by changes are kept",
+			options:  CommitOptions{Changes: []string{"ENV MODE=prod", "CMD run"}},
+			env:      []string{"MODE=prod", "LANG=C.UTF-8"},
+			imageEnv: []string{"LANG=C"},
+			want:     []string{"MODE=prod", "LANG=C"},
+		},
+		{
+			name:     "key without = in the image",
+			env:      []string{"DEBUG=1", "PATH=/usr/bin"},
+			imageEnv: []string{"DEBUG", "PATH=/usr/bin"},
+			want:     []string{"DEBUG", "PATH=/usr/bin"},
+		},
+		{
+			name:     "key without = in the container",
+			env:      []string{"DEBUG", "EXTRA"},
+			imageEnv: []string{"DEBUG=0"},
+			want:     []string{"DEBUG=0"},
+		},
+		{
+			name:    "key without = kept by keepEnv",
+			options: CommitOptions{KeepEnv: []string{"EXTRA"}},
+			env:     []string{"EXTRA"},
+			want:    []string{"EXTRA"},
+		},
+		{
+			name:    "unknown image drops pod, service and hostname variables",
+			options: CommitOptions{PodEnv: []string{"DB_PASSWORD"}},
+			env: []string{"PATH=/usr/bin", "HOSTNAME=pod-0", "DB_PASSWORD=secret", "REDIS_PORT_6379_TCP_ADDR=10.0.0.2",
+				"REDIS_SERVICE_PORT_HTTP=80", "KUBERNETES_SERVICE_HOST=10.0.0.1", "LANG=C"},
+			want: []string{"PATH=/usr/bin", "LANG=C"},
+		},
+		{
+			name:    "unknown image keeps keepEnv",
+			options: CommitOptions{PodEnv: []string{"DB_HOST"}, KeepEnv: []string{"DB_*"}},
+			env:     []string{"DB_HOST=db", "HOSTNAME=pod-0"},
+			want:    []string{"DB_HOST=db"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.filterEnv(tt.env, tt.imageEnv); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterEnv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
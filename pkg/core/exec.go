@@ -0,0 +1,44 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// maxExecOutput is the output of an exec kept for the log, the rest is dropped.
+const maxExecOutput = 64 << 10
+
+// ExecError is returned by Exec when the command exited with a non-zero code.
+type ExecError struct {
+	ExitCode int
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.ExitCode)
+}
+
+// execOutput collects stdout and stderr of an exec up to maxExecOutput bytes.
+type execOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *execOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if free := maxExecOutput - o.buf.Len(); free > 0 {
+		if len(p) > free {
+			o.buf.Write(p[:free])
+		} else {
+			o.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (o *execOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	cerrdefs "github.com/containerd/containerd/errdefs"
+	derrdefs "github.com/docker/docker/errdefs"
+	v1 "imagebuilder/api/v1"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// serverErrorStatus matches the registry 5xx responses surfaced by both runtimes, e.g.
+// "received unexpected HTTP status: 504 Gateway Time-out".
+var serverErrorStatus = regexp.MustCompile(`(status|code)[: ]+5\d\d\b|\b5\d\d (Internal Server Error|Bad Gateway|Service Unavailable|Gateway Time-?out)`)
+
+// registryAuthError matches the auth errors of registries, e.g. "denied: requested access to the
+// resource is denied", "unauthorized: authentication required" or "unexpected status: 401 Unauthorized".
+var registryAuthError = regexp.MustCompile(`(?i)denied: requested access|access to the resource is denied|\bunauthorized: |authentication required|insufficient_scope|(status|code)[: ]+40[13]\b|\b(401 unauthorized|403 forbidden)\b`)
+
+// ContainerNotFoundError is returned by the runtimes when the container to commit, exec into or
+// resume does not exist.
+type ContainerNotFoundError struct {
+	ContainerID string
+	Err         error
+}
+
+func (e *ContainerNotFoundError) Error() string {
+	return fmt.Sprintf("container %s not found: %v", e.ContainerID, e.Err)
+}
+
+func (e *ContainerNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// containerNotFound wraps a not found error of the container lookup in a ContainerNotFoundError.
+func containerNotFound(containerID string, err error) error {
+	if cerrdefs.IsNotFound(err) || derrdefs.IsNotFound(err) {
+		return &ContainerNotFoundError{ContainerID: containerID, Err: err}
+	}
+	return err
+}
+
+// ClassifyError maps an error of the commit, push or save step to a FailureReason.
+// Both runtimes mostly return registry errors as plain strings, so it falls back to
+// matching well known messages.
+func ClassifyError(err error) v1.FailureReason {
+	if err == nil {
+		return ""
+	}
+	msg := strings.ToLower(err.Error())
+	var notFound *ContainerNotFoundError
+
+	switch {
+	// a local permission error is no registry auth error, though its message says denied
+	case errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) ||
+		strings.Contains(msg, "permission denied") || strings.Contains(msg, "operation not permitted"):
+		return v1.FailureUnknown
+	case errors.Is(err, context.DeadlineExceeded):
+		return v1.FailureTimeout
+	case errors.Is(err, syscall.ENOSPC) || strings.Contains(msg, "no space left on device"):
+		return v1.FailureDiskFull
+	case derrdefs.IsUnauthorized(err) || derrdefs.IsForbidden(err) || registryAuthError.MatchString(msg):
+		return v1.FailureAuthDenied
+	// a missing image, content or snapshot is no missing container
+	case errors.As(err, &notFound) || strings.Contains(msg, "no such container"):
+		return v1.FailureContainerNotFound
+	case isNetworkError(err) || serverErrorStatus.MatchString(err.Error()) ||
+		strings.Contains(msg, "connection refused") || strings.Contains(msg, "connection reset") ||
+		strings.Contains(msg, "no such host") || strings.Contains(msg, "i/o timeout") ||
+		strings.Contains(msg, "tls handshake timeout") || cerrdefs.IsUnavailable(err) || derrdefs.IsUnavailable(err):
+		return v1.FailureRegistryUnavailable
+	default:
+		return v1.FailureUnknown
+	}
+}
+
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
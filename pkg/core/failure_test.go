@@ -0,0 +1,58 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	cerrdefs "github.com/containerd/containerd/errdefs"
+	derrdefs "github.com/docker/docker/errdefs"
+	v1 "imagebuilder/api/v1"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want v1.FailureReason
+	}{
+		{name: "nil", err: nil, want: ""},
+		{name: "deadline", err: fmt.Errorf("push: %w", context.DeadlineExceeded), want: v1.FailureTimeout},
+		{name: "ENOSPC", err: &os.PathError{Op: "write", Path: "/output/a.tar", Err: syscall.ENOSPC}, want: v1.FailureDiskFull},
+		{name: "no space message", err: errors.New("write /var/lib/containerd: no space left on device"), want: v1.FailureDiskFull},
+
+		{name: "EACCES", err: &os.PathError{Op: "open", Path: "/output/a.tar", Err: syscall.EACCES}, want: v1.FailureUnknown},
+		{name: "EPERM", err: &os.PathError{Op: "chown", Path: "/output/a.tar", Err: syscall.EPERM}, want: v1.FailureUnknown},
+		{name: "permission denied message", err: errors.New("open /run/containerd/containerd.sock: permission denied"), want: v1.FailureUnknown},
+
+		{name: "docker denied", err: errors.New("denied: requested access to the resource is denied"), want: v1.FailureAuthDenied},
+		{name: "docker unauthorized", err: errors.New("unauthorized: authentication required"), want: v1.FailureAuthDenied},
+		{name: "containerd 401", err: errors.New("failed to authorize: failed to fetch anonymous token: unexpected status: 401 Unauthorized"), want: v1.FailureAuthDenied},
+		{name: "containerd 403", err: errors.New("unexpected status from PUT request to https://r.example.com/v2/a/manifests/v1: 403 Forbidden"), want: v1.FailureAuthDenied},
+		{name: "insufficient scope", err: errors.New("insufficient_scope: authorization failed"), want: v1.FailureAuthDenied},
+		{name: "docker errdefs unauthorized", err: derrdefs.Unauthorized(errors.New("login failed")), want: v1.FailureAuthDenied},
+		{name: "policy violation", err: errors.New("denied: registry r.example.com is not in the insecureRegistries of any ImageBuilderPolicy"), want: v1.FailureUnknown},
+		{name: "policy violation of a named policy", err: errors.New("denied by ImageBuilderPolicy default: destination r.example.com/a is not allowed"), want: v1.FailureUnknown},
+		{name: "number 401 in a message", err: errors.New("layer 401 of 402 is invalid"), want: v1.FailureUnknown},
+
+		{name: "container lookup", err: containerNotFound("abc", cerrdefs.ErrNotFound), want: v1.FailureContainerNotFound},
+		{name: "docker container lookup", err: containerNotFound("abc", derrdefs.NotFound(errors.New("No such container: abc"))), want: v1.FailureContainerNotFound},
+		{name: "nerdctl commit", err: errors.New("no such container abc"), want: v1.FailureContainerNotFound},
+		{name: "missing content", err: fmt.Errorf("content sha256:0123: %w", cerrdefs.ErrNotFound), want: v1.FailureUnknown},
+		{name: "missing image", err: derrdefs.NotFound(errors.New("No such image: a:v1")), want: v1.FailureUnknown},
+
+		{name: "connection refused", err: errors.New("dial tcp 10.0.0.1:443: connect: connection refused"), want: v1.FailureRegistryUnavailable},
+		{name: "server error", err: errors.New("received unexpected HTTP status: 504 Gateway Time-out"), want: v1.FailureRegistryUnavailable},
+		{name: "unavailable", err: cerrdefs.ErrUnavailable, want: v1.FailureRegistryUnavailable},
+		{name: "unknown", err: errors.New("invalid reference format"), want: v1.FailureUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,54 @@
 package core
 
-import "context"
+import (
+	"context"
+	v1 "imagebuilder/api/v1"
+)
+
+// CommitOptions are applied to the image created by Commit.
+type CommitOptions struct {
+	// Changes are Dockerfile instructions, see ApplyChanges.
+	Changes []string
+	Author  string
+	Message string
+	// KeepEnv are glob patterns of injected environment variables kept in the image.
+	KeepEnv []string
+	// PodEnv are the names of the variables set by the env and envFrom of the pod spec.
+	PodEnv []string
+	// PreserveImageConfig resets Entrypoint, Cmd, WorkingDir and User to the original image.
+	PreserveImageConfig bool
+	// ExcludePaths are glob patterns of paths removed from the committed layer.
+	ExcludePaths []string
+	// AddFiles are added in a layer on top of the committed one.
+	AddFiles []File
+	// Squash merges the layers of the image after the files were added.
+	Squash v1.SquashMode
+	// Pause freezes the container during the commit, it is always resumed afterwards.
+	Pause bool
+}
+
+// PushOptions authenticate and secure the push to a registry.
+type PushOptions struct {
+	Username string
+	Password string
+	// TLS of the registry, nil verifies HTTPS against the system CAs.
+	TLS *RegistryTLS
+}
 
 type ImageBuilderAction interface {
-	Commit(ctx context.Context, commitId, to string) error
-	Push(ctx context.Context, ref, user, pwd string) error
+	Commit(ctx context.Context, commitId, to string, opts CommitOptions) error
+	// Push pushes ref and returns the digest of the pushed manifest.
+	Push(ctx context.Context, ref string, opts PushOptions) (string, error)
+	// Tag points target at the local image source.
+	Tag(ctx context.Context, source, target string) error
 	Save(ctx context.Context, imageName, outputPath string) error
+	// ExportRootfs writes the flattened filesystem of imageName as a tar to outputPath.
+	ExportRootfs(ctx context.Context, imageName, outputPath string) error
+	// Inspect describes the local image ref.
+	Inspect(ctx context.Context, ref string) (*v1.ImageStatus, error)
+	// Exec runs command in the container and returns its combined output. A non-zero exit code
+	// is an error.
+	Exec(ctx context.Context, containerID string, command []string) (string, error)
+	// Resume unpauses the container and returns whether it was paused.
+	Resume(ctx context.Context, containerID string) (bool, error)
 }
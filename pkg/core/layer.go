@@ -0,0 +1,118 @@
+package core
+
+import (
+	"archive/tar"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultExcludePaths are removed from every committed layer unless disabled: service account
+// tokens, shell histories, caches and scratch directories.
+var DefaultExcludePaths = []string{
+	"/var/run/secrets/kubernetes.io/serviceaccount",
+	"/run/secrets/kubernetes.io/serviceaccount",
+	"/root/.*_history",
+	"/home/*/.*_history",
+	"/root/.cache",
+	"/home/*/.cache",
+	"/tmp/*",
+	"/var/tmp/*",
+}
+
+// File is added to the image in an extra layer.
+type File struct {
+	// Path is the absolute path of the file in the image.
+	Path string
+	Mode int64
+	Data []byte
+}
+
+// writeFilesLayer writes an uncompressed layer holding files to w. Missing parent directories are
+// created by the runtime when the layer is applied, existing ones keep their owner and mode.
+func writeFilesLayer(w io.Writer, files []File) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, file := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(path.Clean(file.Path), "/"),
+			Mode:     file.Mode,
+			Size:     int64(len(file.Data)),
+			ModTime:  now,
+			Format:   tar.FormatPAX,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = tw.Write(file.Data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// addFilesHistory describes the layer written by writeFilesLayer in the image history.
+func addFilesHistory(files []File) ocispec.History {
+	now := time.Now()
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	return ocispec.History{
+		Created:   &now,
+		CreatedBy: "imagebuilder add files " + strings.Join(paths, " "),
+	}
+}
+
+// whiteoutPrefix marks deleted files in a layer, see the OCI image layer spec.
+const whiteoutPrefix = ".wh."
+
+// excludeMatcher returns whether a layer entry matches one of patterns. A pattern matches a path
+// and everything below it.
+func excludeMatcher(patterns []string) func(name string) bool {
+	return func(name string) bool {
+		name = path.Clean("/" + name)
+		for p := name; p != "/"; p = path.Dir(p) {
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, p); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// filterLayer copies the uncompressed layer r to w without the entries matching exclude and
+// returns the number of removed entries. Whiteouts are kept, removing them would bring back the
+// deleted files of the lower layers.
+func filterLayer(r io.Reader, w io.Writer, exclude func(name string) bool) (int, error) {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	excluded := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return excluded, err
+		}
+		// a hard link to a removed file can not be extracted anymore
+		if !strings.HasPrefix(path.Base(hdr.Name), whiteoutPrefix) &&
+			(exclude(hdr.Name) || (hdr.Typeflag == tar.TypeLink && exclude(hdr.Linkname))) {
+			excluded++
+			continue
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return excluded, err
+		}
+		if _, err = io.Copy(tw, tr); err != nil {
+			return excluded, err
+		}
+	}
+	return excluded, tw.Close()
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExcludeMatcher(t *testing.T) {
+	exclude := excludeMatcher(DefaultExcludePaths)
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "var/run/secrets/kubernetes.io/serviceaccount", want: true},
+		{name: "var/run/secrets/kubernetes.io/serviceaccount/token", want: true},
+		{name: "./run/secrets/kubernetes.io/serviceaccount/ca.crt", want: true},
+		{name: "root/.bash_history", want: true},
+		{name: "home/jane/.python_history", want: true},
+		{name: "home/jane/.cache/pip/http/a", want: true},
+		{name: "tmp/build/a.o", want: true},
+		{name: "tmp", want: false},
+		{name: "tmp/", want: false},
+		{name: "var/tmp", want: false},
+		{name: "root/.bashrc", want: false},
+		{name: "home/jane/app/.cache.go", want: false},
+		{name: "usr/bin/python", want: false},
+	}
+	for _, tt := range tests {
+		if got := exclude(tt.name); got != tt.want {
+			t.Errorf("exclude(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterLayer(t *testing.T) {
+	layer := buildTar(t, []tarEntry{
+		{Name: "tmp/", Type: tar.TypeDir},
+		{Name: "tmp/cache", Body: "cache"},
+		{Name: "tmp/.wh.old"},
+		{Name: "app/", Type: tar.TypeDir},
+		{Name: "app/main.py", Body: "print()"},
+		{Name: "app/cache", Type: tar.TypeLink, Linkname: "tmp/cache"},
+		{Name: "app/main", Type: tar.TypeLink, Linkname: "app/main.py"},
+		{Name: "app/tmp", Type: tar.TypeSymlink, Linkname: "/tmp/cache"},
+	})
+	want := []tarEntry{
+		{Name: "tmp/", Type: tar.TypeDir},
+		{Name: "tmp/.wh.old", Type: tar.TypeReg},
+		{Name: "app/", Type: tar.TypeDir},
+		{Name: "app/main.py", Type: tar.TypeReg, Body: "print()"},
+		{Name: "app/main", Type: tar.TypeLink, Linkname: "app/main.py"},
+		{Name: "app/tmp", Type: tar.TypeSymlink, Linkname: "/tmp/cache"},
+	}
+
+	buf := &bytes.Buffer{}
+	excluded, err := filterLayer(bytes.NewReader(layer), buf, excludeMatcher([]string{"/tmp/*"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if excluded != 2 {
+		t.Errorf("filterLayer() excluded %d entries, want 2", excluded)
+	}
+	if got := readTar(t, buf.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("filterLayer() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteFilesLayer(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := writeFilesLayer(buf, []File{
+		{Path: "/etc/app/config.yaml", Mode: 0644, Data: []byte("a: 1")},
+		{Path: "/opt/../usr/local/bin/run", Mode: 0755, Data: []byte("#!/bin/sh")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tarEntry{
+		{Name: "etc/app/config.yaml", Type: tar.TypeReg, Body: "a: 1"},
+		{Name: "usr/local/bin/run", Type: tar.TypeReg, Body: "#!/bin/sh"},
+	}
+	if got := readTar(t, buf.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("writeFilesLayer() = %+v, want %+v", got, want)
+	}
+}
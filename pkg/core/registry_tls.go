@@ -0,0 +1,51 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// RegistryTLS is the TLS configuration of a registry with the CA bundle and the client certificate
+// read from their Secrets and ConfigMaps.
+type RegistryTLS struct {
+	PlainHTTP          bool
+	InsecureSkipVerify bool
+	// CA is a PEM bundle trusted in addition to the system CAs.
+	CA []byte
+	// ClientCert and ClientKey are the PEM client certificate and its key.
+	ClientCert []byte
+	ClientKey  []byte
+}
+
+// Insecure tells whether the registry is accessed without verified TLS.
+func (t *RegistryTLS) Insecure() bool {
+	return t != nil && (t.PlainHTTP || t.InsecureSkipVerify)
+}
+
+// Config returns the tls.Config of the registry, nil t verifies against the system CAs.
+func (t *RegistryTLS) Config() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t == nil {
+		return config, nil
+	}
+	config.InsecureSkipVerify = t.InsecureSkipVerify
+	if len(t.CA) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(t.CA) {
+			return nil, fmt.Errorf("no certificate found in the CA bundle")
+		}
+		config.RootCAs = pool
+	}
+	if len(t.ClientCert) > 0 {
+		cert, err := tls.X509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
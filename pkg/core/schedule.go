@@ -0,0 +1,20 @@
+package core
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"time"
+)
+
+// ParseSchedule parses the cron schedule of an ImageBuilderSchedule. The runs are named after the
+// minute they were scheduled for, so "@every" intervals below a minute are rejected.
+func ParseSchedule(spec string) (cron.Schedule, error) {
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, err
+	}
+	if every, ok := sched.(cron.ConstantDelaySchedule); ok && every.Delay < time.Minute {
+		return nil, fmt.Errorf("runs at most once a minute, got an interval of %s", every.Delay)
+	}
+	return sched, nil
+}
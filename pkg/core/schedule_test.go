@@ -0,0 +1,26 @@
+package core
+
+import "testing"
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "0 2 * * *"},
+		{spec: "* * * * *"},
+		{spec: "@daily"},
+		{spec: "@every 1m"},
+		{spec: "@every 90s"},
+		{spec: "@every 59s", wantErr: true},
+		{spec: "@every 1s", wantErr: true},
+		{spec: "@every 1m30ms"},
+		{spec: "0 0 2 * * *", wantErr: true},
+		{spec: "not a schedule", wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSchedule(tt.spec); (err != nil) != tt.wantErr {
+			t.Errorf("ParseSchedule(%q) = %v, want error %v", tt.spec, err, tt.wantErr)
+		}
+	}
+}
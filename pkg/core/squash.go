@@ -0,0 +1,230 @@
+package core
+
+import (
+	"archive/tar"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// opaqueWhiteout hides the content of the lower layers in its directory.
+const opaqueWhiteout = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+// layerOpener opens the uncompressed content of a layer, squashLayers reads every layer twice.
+type layerOpener func() (io.ReadCloser, error)
+
+type entryKey struct {
+	layer, index int
+}
+
+// squashPlan is the result of the first pass of squashLayers.
+type squashPlan struct {
+	// keep tells for every entry of every layer whether it is part of the squashed layer.
+	keep [][]bool
+	// links are kept hard links whose target was dropped, mapped to the target. They are
+	// written as a copy of the target.
+	links map[entryKey]entryKey
+	// targets are the dropped entries referenced by links.
+	targets map[entryKey]bool
+}
+
+// squashLayers merges layers, ordered from the lowest, into a single uncompressed layer written
+// to w. Entries replaced by an upper layer or deleted by a whiteout are dropped. keepWhiteouts
+// keeps the whiteouts, they are needed when the squashed layer is applied on top of other layers.
+func squashLayers(layers []layerOpener, w io.Writer, keepWhiteouts bool) error {
+	plan, err := planSquash(layers, keepWhiteouts)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for i, open := range layers {
+		if err = squashLayer(i, open, tw, plan); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// planSquash reads the headers of the layers from the top and decides which entries are visible.
+func planSquash(layers []layerOpener, keepWhiteouts bool) (*squashPlan, error) {
+	plan := &squashPlan{
+		keep:    make([][]bool, len(layers)),
+		links:   map[entryKey]entryKey{},
+		targets: map[entryKey]bool{},
+	}
+	// upper maps the paths of the upper layers to whether they are directories
+	upper := map[string]bool{}
+	deleted := map[string]bool{}
+	opaque := map[string]bool{}
+	whiteouts := map[string]bool{}
+
+	hidden := func(name string) bool {
+		if _, ok := upper[name]; ok || deleted[name] {
+			return true
+		}
+		for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+			if isDir, ok := upper[dir]; deleted[dir] || opaque[dir] || (ok && !isDir) {
+				return true
+			}
+		}
+		return opaque["/"]
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		layerPaths := map[string]bool{}
+		layerIndex := map[string]int{}
+		var layerDeleted, layerOpaque []string
+
+		err := readTarHeaders(layers[i], func(index int, hdr *tar.Header) {
+			name := path.Clean("/" + hdr.Name)
+			base := path.Base(name)
+			keep := false
+			switch {
+			case base == opaqueWhiteout:
+				layerOpaque = append(layerOpaque, path.Dir(name))
+				keep = keepWhiteouts && !whiteouts[name]
+				whiteouts[name] = true
+			case strings.HasPrefix(base, whiteoutPrefix):
+				layerDeleted = append(layerDeleted, path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)))
+				keep = keepWhiteouts && !whiteouts[name]
+				whiteouts[name] = true
+			default:
+				keep = !hidden(name)
+				layerPaths[name] = hdr.Typeflag == tar.TypeDir
+				layerIndex[name] = index
+				if keep && hdr.Typeflag == tar.TypeLink {
+					target, ok := layerIndex[path.Clean("/"+hdr.Linkname)]
+					if ok && !plan.keep[i][target] {
+						plan.links[entryKey{i, index}] = entryKey{i, target}
+						plan.targets[entryKey{i, target}] = true
+					}
+				}
+			}
+			plan.keep[i] = append(plan.keep[i], keep)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for name, isDir := range layerPaths {
+			upper[name] = isDir
+		}
+		for _, name := range layerDeleted {
+			deleted[name] = true
+		}
+		for _, dir := range layerOpaque {
+			opaque[dir] = true
+		}
+	}
+	return plan, nil
+}
+
+func readTarHeaders(open layerOpener, read func(index int, hdr *tar.Header)) error {
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		read(index, hdr)
+	}
+}
+
+// squashLayer copies the kept entries of layer i to tw.
+func squashLayer(i int, open layerOpener, tw *tar.Writer, plan *squashPlan) error {
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	type target struct {
+		hdr  *tar.Header
+		file *os.File
+	}
+	targets := map[int]target{}
+	defer func() {
+		for _, t := range targets {
+			t.file.Close()
+			os.Remove(t.file.Name())
+		}
+	}()
+
+	tr := tar.NewReader(rc)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key := entryKey{i, index}
+
+		if plan.targets[key] {
+			// keep the content of a dropped file for the hard links to it
+			file, err := os.CreateTemp("", "squash-*")
+			if err != nil {
+				return err
+			}
+			targets[index] = target{hdr: hdr, file: file}
+			if _, err = io.Copy(file, tr); err != nil {
+				return err
+			}
+		}
+		if !plan.keep[i][index] {
+			continue
+		}
+
+		if linked, ok := plan.links[key]; ok {
+			t := targets[linked.index]
+			copied := *t.hdr
+			copied.Name = hdr.Name
+			if err = tw.WriteHeader(&copied); err != nil {
+				return err
+			}
+			if _, err = t.file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err = io.Copy(tw, t.file); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// squashHistory replaces the history of the squashed layers, the ones from layer from on, by
+// a single entry.
+func squashHistory(history []ocispec.History, from int, squashed ocispec.History) []ocispec.History {
+	var kept []ocispec.History
+	layers := 0
+	for _, h := range history {
+		if layers >= from {
+			break
+		}
+		kept = append(kept, h)
+		if !h.EmptyLayer {
+			layers++
+		}
+	}
+	return append(kept, squashed)
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// tarEntry is a layer entry of the tests, Type defaults to a regular file.
+type tarEntry struct {
+	Name     string
+	Type     byte
+	Linkname string
+	Body     string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.Name, Typeflag: entry.Type, Linkname: entry.Linkname, Mode: 0644}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(entry.Body))
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readTar(t *testing.T, data []byte) []tarEntry {
+	t.Helper()
+	var entries []tarEntry
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{Name: hdr.Name, Type: hdr.Typeflag, Linkname: hdr.Linkname, Body: string(body)})
+	}
+}
+
+func TestSquashLayers(t *testing.T) {
+	tests := []struct {
+		name          string
+		layers        [][]tarEntry
+		keepWhiteouts bool
+		want          []tarEntry
+	}{
+		{
+			name: "upper file replaces lower file",
+			layers: [][]tarEntry{
+				{{Name: "app/", Type: tar.TypeDir}, {Name: "app/a", Body: "old"}, {Name: "app/b", Body: "b"}},
+				{{Name: "app/a", Body: "new"}},
+			},
+			want: []tarEntry{
+				{Name: "app/", Type: tar.TypeDir}, {Name: "app/b", Type: tar.TypeReg, Body: "b"},
+				{Name: "app/a", Type: tar.TypeReg, Body: "new"},
+			},
+		},
+		{
+			name: "whiteout deletes lower file",
+			layers: [][]tarEntry{
+				{{Name: "app/", Type: tar.TypeDir}, {Name: "app/a", Body: "a"}, {Name: "app/b", Body: "b"}},
+				{{Name: "app/.wh.a"}},
+			},
+			want: []tarEntry{{Name: "app/", Type: tar.TypeDir}, {Name: "app/b", Type: tar.TypeReg, Body: "b"}},
+		},
+		{
+			name: "whiteout kept on top of other layers",
+			layers: [][]tarEntry{
+				{{Name: "app/a", Body: "a"}},
+				{{Name: "app/.wh.a"}, {Name: "app/.wh.c"}},
+			},
+			keepWhiteouts: true,
+			want:          []tarEntry{{Name: "app/.wh.a", Type: tar.TypeReg}, {Name: "app/.wh.c", Type: tar.TypeReg}},
+		},
+		{
+			name: "whiteout deletes lower directory",
+			layers: [][]tarEntry{
+				{{Name: "app/", Type: tar.TypeDir}, {Name: "app/a", Body: "a"}, {Name: "etc/x", Body: "x"}},
+				{{Name: ".wh.app"}},
+			},
+			want: []tarEntry{{Name: "etc/x", Type: tar.TypeReg, Body: "x"}},
+		},
+		{
+			name: "opaque directory hides lower content",
+			layers: [][]tarEntry{
+				{{Name: "app/", Type: tar.TypeDir}, {Name: "app/old", Body: "old"}, {Name: "etc/x", Body: "x"}},
+				{{Name: "app/", Type: tar.TypeDir}, {Name: "app/.wh..wh..opq"}, {Name: "app/new", Body: "new"}},
+			},
+			keepWhiteouts: true,
+			want: []tarEntry{
+				{Name: "etc/x", Type: tar.TypeReg, Body: "x"},
+				{Name: "app/", Type: tar.TypeDir}, {Name: "app/.wh..wh..opq", Type: tar.TypeReg}, {Name: "app/new", Type: tar.TypeReg, Body: "new"},
+			},
+		},
+		{
+			name: "file replaces lower directory",
+			layers: [][]tarEntry{
+				{{Name: "app/", Type: tar.TypeDir}, {Name: "app/a", Body: "a"}},
+				{{Name: "app", Body: "file"}},
+			},
+			want: []tarEntry{{Name: "app", Type: tar.TypeReg, Body: "file"}},
+		},
+		{
+			name: "hard link to a dropped target becomes a copy",
+			layers: [][]tarEntry{
+				{{Name: "bin/a", Body: "data"}, {Name: "bin/b", Type: tar.TypeLink, Linkname: "bin/a"}},
+				{{Name: "bin/.wh.a"}},
+			},
+			want: []tarEntry{{Name: "bin/b", Type: tar.TypeReg, Body: "data"}},
+		},
+		{
+			name: "hard link to a kept target stays a link",
+			layers: [][]tarEntry{
+				{{Name: "bin/a", Body: "data"}, {Name: "bin/b", Type: tar.TypeLink, Linkname: "bin/a"}},
+				{{Name: "bin/c", Body: "c"}},
+			},
+			want: []tarEntry{
+				{Name: "bin/a", Type: tar.TypeReg, Body: "data"}, {Name: "bin/b", Type: tar.TypeLink, Linkname: "bin/a"},
+				{Name: "bin/c", Type: tar.TypeReg, Body: "c"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var layers []layerOpener
+			for _, entries := range tt.layers {
+				data := buildTar(t, entries)
+				layers = append(layers, func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(data)), nil
+				})
+			}
+			buf := &bytes.Buffer{}
+			if err := squashLayers(layers, buf, tt.keepWhiteouts); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTar(t, buf.Bytes()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("squashLayers() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	v1 "imagebuilder/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const (
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindReplicaSet  = "ReplicaSet"
+)
+
+// WorkloadPodTemplate returns the pod selector and pod template of the workload referenced by ref.
+func WorkloadPodTemplate(ctx context.Context, reader client.Reader, namespace string, ref *v1.TargetReference) (*metav1.LabelSelector, *corev1.PodTemplateSpec, error) {
+	key := client.ObjectKey{Namespace: namespace, Name: ref.Name}
+	switch ref.Kind {
+	case KindDeployment:
+		workload := &appsv1.Deployment{}
+		if err := reader.Get(ctx, key, workload); err != nil {
+			return nil, nil, err
+		}
+		return workload.Spec.Selector, &workload.Spec.Template, nil
+	case KindStatefulSet:
+		workload := &appsv1.StatefulSet{}
+		if err := reader.Get(ctx, key, workload); err != nil {
+			return nil, nil, err
+		}
+		return workload.Spec.Selector, &workload.Spec.Template, nil
+	case KindReplicaSet:
+		workload := &appsv1.ReplicaSet{}
+		if err := reader.Get(ctx, key, workload); err != nil {
+			return nil, nil, err
+		}
+		return workload.Spec.Selector, &workload.Spec.Template, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported targetRef kind %s", ref.Kind)
+	}
+}
+
+// ResolveTargetPod returns the running pod selected by spec.podName, spec.targetRef or spec.selector.
+// targetRef and selector must match exactly one running pod.
+func ResolveTargetPod(ctx context.Context, reader client.Reader, spec *v1.ImageBuilderSpec) (*corev1.Pod, error) {
+	namespace := spec.Namespace
+	if spec.PodName != "" {
+		return getRunningPod(ctx, reader, namespace, spec.PodName)
+	}
+
+	var selector *metav1.LabelSelector
+	var target string
+	switch {
+	case spec.TargetRef != nil:
+		ref := spec.TargetRef
+		target = fmt.Sprintf("%s %s/%s", ref.Kind, namespace, ref.Name)
+		if ref.Kind == KindStatefulSet && ref.Ordinal != nil {
+			return getRunningPod(ctx, reader, namespace, fmt.Sprintf("%s-%d", ref.Name, *ref.Ordinal))
+		}
+		workloadSelector, _, err := WorkloadPodTemplate(ctx, reader, namespace, ref)
+		if err != nil {
+			return nil, err
+		}
+		selector = workloadSelector
+	case spec.Selector != nil:
+		selector = spec.Selector
+		target = fmt.Sprintf("selector %s in namespace %s", metav1.FormatLabelSelector(selector), namespace)
+	default:
+		return nil, fmt.Errorf("one of podName, targetRef or selector is required")
+	}
+
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	pods := &corev1.PodList{}
+	err = reader.List(ctx, pods, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: labelSelector})
+	if err != nil {
+		return nil, err
+	}
+
+	var running []corev1.Pod
+	for _, pod := range pods.Items {
+		if isRunning(&pod) {
+			running = append(running, pod)
+		}
+	}
+	switch len(running) {
+	case 0:
+		return nil, fmt.Errorf("no running pod matches %s", target)
+	case 1:
+		return &running[0], nil
+	default:
+		names := make([]string, 0, len(running))
+		for _, pod := range running {
+			names = append(names, pod.Name)
+		}
+		return nil, fmt.Errorf("%d running pods match %s: %s", len(running), target, strings.Join(names, ", "))
+	}
+}
+
+// getRunningPod returns the named pod if it is running and not being deleted.
+func getRunningPod(ctx context.Context, reader client.Reader, namespace, name string) (*corev1.Pod, error) {
+	pod := &corev1.Pod{}
+	if err := reader.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, pod); err != nil {
+		return nil, err
+	}
+	if pod.DeletionTimestamp != nil {
+		return nil, fmt.Errorf("pod %s/%s is being deleted", namespace, name)
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return nil, fmt.Errorf("pod %s/%s is not running, phase is %s", namespace, name, pod.Status.Phase)
+	}
+	return pod, nil
+}
+
+func isRunning(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp == nil && pod.Status.Phase == corev1.PodRunning
+}
+
+// ContainerRuntime returns the container runtime of node, e.g. docker or containerd.
+func ContainerRuntime(node *corev1.Node) string {
+	return strings.Split(node.Status.NodeInfo.ContainerRuntimeVersion, "://")[0]
+}
@@ -1,12 +1,17 @@
 package core
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	v12 "imagebuilder/api/v1"
+	"imagebuilder/pkg/constant"
 	v1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/utils/pointer"
+	"strings"
+	"time"
 )
 
 type JobOptions struct {
@@ -17,19 +22,108 @@ type JobOptions struct {
 	ContainerId   string
 	NodeName      string
 	ImageHostPath v12.LocalHostPath
+	// Timeout of the build, zero for none.
+	Timeout time.Duration
+	// PostCommitHookTimeout bounds the post commit hook, which also runs after the build timed out.
+	PostCommitHookTimeout time.Duration
+}
+
+// jobTimeoutGracePeriod is added to the deadline of the job, so the build can report its
+// own timeout before the job is killed.
+const jobTimeoutGracePeriod = 30 * time.Second
+
+// DefaultPostCommitHookTimeout bounds a post commit hook without timeout, it is not bounded by the
+// timeout of the build.
+const DefaultPostCommitHookTimeout = 5 * time.Minute
+
+// ContainerResumeTimeout bounds the resume of the container after the commit, it is not bounded
+// by the timeout of the build either.
+const ContainerResumeTimeout = time.Minute
+
+// PostCommitHookTimeout returns how long the post commit hook of spec may run, zero without hook.
+func PostCommitHookTimeout(spec *v12.CommitSpec) time.Duration {
+	if spec == nil || spec.PostCommitHook == nil {
+		return 0
+	}
+	if spec.PostCommitHook.Timeout != nil {
+		return spec.PostCommitHook.Timeout.Duration
+	}
+	return DefaultPostCommitHookTimeout
+}
+
+// jobActiveDeadline returns the deadline of the builder job, nil without build timeout. A build
+// timing out during the commit still resumes the container and runs the post commit hook, both
+// are added before the grace period.
+func jobActiveDeadline(o JobOptions) *int64 {
+	if o.Timeout <= 0 {
+		return nil
+	}
+	deadline := o.Timeout + ContainerResumeTimeout + o.PostCommitHookTimeout + jobTimeoutGracePeriod
+	return pointer.Int64(int64(deadline.Seconds()))
+}
+
+// recoveryJobDeadline bounds the job resuming a container, it only talks to the runtime.
+const recoveryJobDeadline = 5 * time.Minute
+
+// maxJobNameLength keeps the job-name label of the pods and their generated names valid, like
+// the limit CronJob applies to its names.
+const maxJobNameLength = 52
+
+// JobName is the name of the builder job of the ImageBuilder namespace/name. The jobs of all
+// namespaces live in the manager namespace, so the name carries a hash of both.
+func JobName(namespace, name string) string {
+	return jobName(namespace, name, "")
+}
+
+// RecoveryJobName is the name of the job resuming the container of the ImageBuilder namespace/name.
+func RecoveryJobName(namespace, name string) string {
+	return jobName(namespace, name, "-recover")
+}
+
+func jobName(namespace, name, suffix string) string {
+	sum := sha256.Sum256([]byte(namespace + "/" + name))
+	suffix += "-" + hex.EncodeToString(sum[:])[:10]
+	if len(name) > maxJobNameLength-len(suffix) {
+		name = strings.TrimRight(name[:maxJobNameLength-len(suffix)], "-.")
+	}
+	return name + suffix
+}
+
+// OwnsJob tells whether job was created for the ImageBuilder namespace/name.
+func OwnsJob(job *v1.Job, namespace, name string) bool {
+	return job.Labels[constant.LabelImageBuilderName] == name && job.Labels[constant.LabelImageBuilderNamespace] == namespace
+}
+
+// RecoveryJobTemplate returns the job resuming the container of a builder job that terminated
+// while the container was paused for the commit.
+func RecoveryJobTemplate(o JobOptions) *v1.Job {
+	job := JobTemplate(o)
+	job.Name = RecoveryJobName(o.Namespace, o.Name)
+	// resuming is idempotent, unlike the build it can be retried by a new pod
+	job.Spec.BackoffLimit = pointer.Int32(2)
+	job.Spec.ActiveDeadlineSeconds = pointer.Int64(int64(recoveryJobDeadline.Seconds()))
+	job.Spec.Template.Spec.Containers[0].Args = []string{"recover", "--name", o.Name, "--namespace", o.Namespace, "--container-id", o.ContainerId}
+	return job
 }
 
 func JobTemplate(o JobOptions) *v1.Job {
 
 	privileged := true
+	hostPathDirectoryOrCreate := corev1.HostPathDirectoryOrCreate
 
 	return &v1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      o.Name,
+			Name:      JobName(o.Namespace, o.Name),
 			Namespace: o.JobNamespace,
+			Labels: map[string]string{
+				constant.LabelImageBuilderName:      o.Name,
+				constant.LabelImageBuilderNamespace: o.Namespace,
+			},
 		},
 		Spec: v1.JobSpec{
-			BackoffLimit: pointer.Int32(2),
+			// the job retries its steps itself according to spec.retryPolicy, a new pod would commit again
+			BackoffLimit:          pointer.Int32(0),
+			ActiveDeadlineSeconds: jobActiveDeadline(o),
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Annotations: map[string]string{"sidecar.istio.io/inject": "false"},
@@ -49,6 +143,10 @@ func JobTemplate(o JobOptions) *v1.Job {
 						}, {
 							Name:      "containerd-socket",
 							MountPath: "/run/containerd/containerd.sock",
+						}, {
+							// the shim of an exec opens the fifos of its streams on the node
+							Name:      "containerd-fifo",
+							MountPath: containerdFIFODir,
 						}, {
 							Name:      "image-save-path",
 							MountPath: o.ImageHostPath.DefaultContainerPath(),
@@ -75,6 +173,12 @@ func JobTemplate(o JobOptions) *v1.Job {
 								HostPath: &corev1.HostPathVolumeSource{Path: "/run/containerd/containerd.sock"},
 							},
 						},
+						{
+							Name: "containerd-fifo",
+							VolumeSource: corev1.VolumeSource{
+								HostPath: &corev1.HostPathVolumeSource{Path: containerdFIFODir, Type: &hostPathDirectoryOrCreate},
+							},
+						},
 						{
 							Name: "image-save-path",
 							VolumeSource: corev1.VolumeSource{
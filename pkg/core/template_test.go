@@ -0,0 +1,38 @@
+package core
+
+import (
+	v1 "imagebuilder/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestJobActiveDeadline(t *testing.T) {
+	hook := func(timeout *metav1.Duration) *v1.CommitSpec {
+		return &v1.CommitSpec{PostCommitHook: &v1.CommitHook{Command: []string{"true"}, Timeout: timeout}}
+	}
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		commit  *v1.CommitSpec
+		want    int64
+	}{
+		{name: "no timeout", commit: hook(nil), want: -1},
+		{name: "no post commit hook", timeout: 10 * time.Minute, want: 600 + 60 + 30},
+		{name: "commit without hooks", timeout: 10 * time.Minute, commit: &v1.CommitSpec{}, want: 600 + 60 + 30},
+		{name: "default post commit hook timeout", timeout: 10 * time.Minute, commit: hook(nil), want: 600 + 60 + 300 + 30},
+		{name: "post commit hook timeout", timeout: 90 * time.Second, commit: hook(&metav1.Duration{Duration: 20 * time.Minute}), want: 90 + 60 + 1200 + 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := jobActiveDeadline(JobOptions{Timeout: tt.timeout, PostCommitHookTimeout: PostCommitHookTimeout(tt.commit)})
+			seconds := int64(-1)
+			if got != nil {
+				seconds = *got
+			}
+			if seconds != tt.want {
+				t.Errorf("jobActiveDeadline() = %d, want %d", seconds, tt.want)
+			}
+		})
+	}
+}
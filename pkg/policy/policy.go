@@ -0,0 +1,171 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	v1 "imagebuilder/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"path"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+// Violation is returned when an ImageBuilderPolicy rejects an ImageBuilder.
+type Violation struct {
+	Policy  string
+	Message string
+}
+
+func (v *Violation) Error() string {
+	if v.Policy == "" {
+		return "denied: " + v.Message
+	}
+	return fmt.Sprintf("denied by ImageBuilderPolicy %s: %s", v.Policy, v.Message)
+}
+
+func List(ctx context.Context, reader client.Reader) ([]v1.ImageBuilderPolicy, error) {
+	policies := &v1.ImageBuilderPolicyList{}
+	if err := reader.List(ctx, policies); err != nil {
+		return nil, fmt.Errorf("list ImageBuilderPolicies: %w", err)
+	}
+	return policies.Items, nil
+}
+
+// CheckSpec checks the destinations, host path and namespaces of builder against every policy.
+// pod is nil as long as the target is not resolved, the pod selectors of namespace rules are
+// then not checked.
+func CheckSpec(policies []v1.ImageBuilderPolicy, builder *v1.ImageBuilder, pod *corev1.Pod) error {
+	for i := range policies {
+		policy := &policies[i]
+		for _, destination := range builder.Spec.PushDestinations() {
+			if err := checkDestination(policy, destination.To); err != nil {
+				return err
+			}
+		}
+		if err := checkHostPath(policy, &builder.Spec); err != nil {
+			return err
+		}
+		if err := checkNamespaces(policy, builder, pod); err != nil {
+			return err
+		}
+	}
+	for _, destination := range builder.Spec.PushDestinations() {
+		if err := checkInsecure(policies, destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkInsecure allows plainHTTP and insecureSkipVerify only for registries listed in the
+// insecureRegistries of a policy.
+func checkInsecure(policies []v1.ImageBuilderPolicy, destination v1.Destination) error {
+	if !destination.TLS.Insecure() {
+		return nil
+	}
+	named, err := refdocker.ParseDockerRef(destination.To)
+	if err != nil {
+		return err
+	}
+	host := refdocker.Domain(named)
+	for _, policy := range policies {
+		if matchAny(policy.Spec.InsecureRegistries, host) {
+			return nil
+		}
+	}
+	return &Violation{Message: fmt.Sprintf("registry %s is not in the insecureRegistries of any ImageBuilderPolicy", host)}
+}
+
+// CheckImageSize checks the size of a committed image against every policy. A negative size is
+// unknown, it violates every policy with a maxImageSize.
+func CheckImageSize(policies []v1.ImageBuilderPolicy, size int64) error {
+	for _, policy := range policies {
+		if policy.Spec.MaxImageSize != nil && size < 0 {
+			return &Violation{Policy: policy.Name, Message: fmt.Sprintf("the image size is unknown, it can not be checked against %s",
+				policy.Spec.MaxImageSize.String())}
+		}
+		if policy.Spec.MaxImageSize != nil && size > policy.Spec.MaxImageSize.Value() {
+			return &Violation{Policy: policy.Name, Message: fmt.Sprintf("image size %s exceeds %s",
+				resource.NewQuantity(size, resource.BinarySI).String(), policy.Spec.MaxImageSize.String())}
+		}
+	}
+	return nil
+}
+
+func checkDestination(policy *v1.ImageBuilderPolicy, to string) error {
+	if len(policy.Spec.AllowedDestinations) == 0 {
+		return nil
+	}
+	named, err := refdocker.ParseDockerRef(to)
+	if err != nil {
+		return err
+	}
+	destination := refdocker.Domain(named) + "/" + refdocker.Path(named)
+	if matchAny(policy.Spec.AllowedDestinations, destination) {
+		return nil
+	}
+	return &Violation{Policy: policy.Name, Message: fmt.Sprintf("destination %s is not allowed", destination)}
+}
+
+// checkHostPath only applies when something is written to the host path, i.e. for save, exportRootfs
+// or an explicit path.
+func checkHostPath(policy *v1.ImageBuilderPolicy, spec *v1.ImageBuilderSpec) error {
+	writes := spec.HasOperation(v1.Save) || spec.HasOperation(v1.ExportRootfs)
+	if len(policy.Spec.AllowedHostPathPrefixes) == 0 || (spec.LocalHostPath == "" && !writes) {
+		return nil
+	}
+	hostPath := path.Clean(spec.LocalHostPath.DefaultNodePath())
+	for _, prefix := range policy.Spec.AllowedHostPathPrefixes {
+		prefix = path.Clean(prefix)
+		if hostPath == prefix || strings.HasPrefix(hostPath, strings.TrimSuffix(prefix, "/")+"/") {
+			return nil
+		}
+	}
+	return &Violation{Policy: policy.Name, Message: fmt.Sprintf("host path %s is not allowed", hostPath)}
+}
+
+func checkNamespaces(policy *v1.ImageBuilderPolicy, builder *v1.ImageBuilder, pod *corev1.Pod) error {
+	if len(policy.Spec.NamespaceRules) == 0 {
+		return nil
+	}
+	podNamespace := builder.Spec.Namespace
+	if podNamespace == "" {
+		podNamespace = builder.Namespace
+	}
+	for _, rule := range policy.Spec.NamespaceRules {
+		if !matchAny(rule.Namespaces, builder.Namespace) {
+			continue
+		}
+		if len(rule.PodNamespaces) == 0 && podNamespace != builder.Namespace {
+			continue
+		}
+		if len(rule.PodNamespaces) > 0 && !matchAny(rule.PodNamespaces, podNamespace) {
+			continue
+		}
+		if pod != nil && rule.PodSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(rule.PodSelector)
+			if err != nil || !selector.Matches(labels.Set(pod.Labels)) {
+				continue
+			}
+		}
+		return nil
+	}
+	target := podNamespace
+	if pod != nil {
+		target = podNamespace + "/" + pod.Name
+	}
+	return &Violation{Policy: policy.Name, Message: fmt.Sprintf("namespace %s may not snapshot pods of %s", builder.Namespace, target)}
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
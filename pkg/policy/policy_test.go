@@ -0,0 +1,199 @@
+package policy
+
+import (
+	"errors"
+	v1 "imagebuilder/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func newPolicy(name string, spec v1.ImageBuilderPolicySpec) v1.ImageBuilderPolicy {
+	return v1.ImageBuilderPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+}
+
+func newBuilder(namespace string, spec v1.ImageBuilderSpec) *v1.ImageBuilder {
+	return &v1.ImageBuilder{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "ib"}, Spec: spec}
+}
+
+// checkViolation fails t unless err is a Violation exactly when wantViolation is set.
+func checkViolation(t *testing.T, err error, wantViolation bool) {
+	t.Helper()
+	var violation *Violation
+	switch {
+	case wantViolation && !errors.As(err, &violation):
+		t.Errorf("got %v, want a violation", err)
+	case !wantViolation && err != nil:
+		t.Errorf("got %v, want no error", err)
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	policy := newPolicy("registries", v1.ImageBuilderPolicySpec{
+		AllowedDestinations: []string{"registry.example.com/team-a/*", "docker.io/library/*"},
+	})
+	tests := []struct {
+		to            string
+		wantViolation bool
+	}{
+		{to: "registry.example.com/team-a/app:v1"},
+		{to: "registry.example.com/team-a/app@sha256:" + "0123456789012345678901234567890123456789012345678901234567890123"},
+		{to: "nginx:latest"},
+		{to: "registry.example.com/team-b/app:v1", wantViolation: true},
+		{to: "registry.example.com/team-a/nested/app:v1", wantViolation: true},
+		{to: "registry.example.com:5000/team-a/app:v1", wantViolation: true},
+		{to: "evil.example.com/team-a/app:v1", wantViolation: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.to, func(t *testing.T) {
+			checkViolation(t, checkDestination(&policy, tt.to), tt.wantViolation)
+		})
+	}
+
+	if err := checkDestination(&v1.ImageBuilderPolicy{}, "anything.example.com/a:b"); err != nil {
+		t.Errorf("a policy without allowedDestinations got %v", err)
+	}
+	if err := checkDestination(&policy, "Invalid Reference"); err == nil {
+		t.Errorf("an invalid reference got no error")
+	}
+}
+
+func TestCheckHostPath(t *testing.T) {
+	policy := newPolicy("paths", v1.ImageBuilderPolicySpec{AllowedHostPathPrefixes: []string{"/data/images/", "/mnt/export"}})
+	tests := []struct {
+		name          string
+		spec          v1.ImageBuilderSpec
+		wantViolation bool
+	}{
+		{name: "push writes nothing", spec: v1.ImageBuilderSpec{Operator: v1.Push}},
+		{name: "allowed prefix", spec: v1.ImageBuilderSpec{Operator: v1.Save, LocalHostPath: "/data/images/team-a"}},
+		{name: "prefix itself", spec: v1.ImageBuilderSpec{Operator: v1.Save, LocalHostPath: "/mnt/export"}},
+		{name: "export rootfs", spec: v1.ImageBuilderSpec{Operations: []v1.OperatorType{v1.Push, v1.ExportRootfs}, LocalHostPath: "/mnt/export/a"}},
+		{name: "sibling of a prefix", spec: v1.ImageBuilderSpec{Operator: v1.Save, LocalHostPath: "/mnt/export2"}, wantViolation: true},
+		{name: "escapes the prefix", spec: v1.ImageBuilderSpec{Operator: v1.Save, LocalHostPath: "/data/images/../../etc"}, wantViolation: true},
+		{name: "default path", spec: v1.ImageBuilderSpec{Operator: v1.Save}, wantViolation: true},
+		{name: "explicit path with push", spec: v1.ImageBuilderSpec{Operator: v1.Push, LocalHostPath: "/var/lib"}, wantViolation: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkViolation(t, checkHostPath(&policy, &tt.spec), tt.wantViolation)
+		})
+	}
+
+	if err := checkHostPath(&v1.ImageBuilderPolicy{}, &v1.ImageBuilderSpec{Operator: v1.Save, LocalHostPath: "/etc"}); err != nil {
+		t.Errorf("a policy without allowedHostPathPrefixes got %v", err)
+	}
+}
+
+func TestCheckNamespaces(t *testing.T) {
+	policy := newPolicy("namespaces", v1.ImageBuilderPolicySpec{NamespaceRules: []v1.NamespaceRule{
+		{Namespaces: []string{"team-*"}},
+		{Namespaces: []string{"ops"}, PodNamespaces: []string{"team-*", "ops"}},
+		{Namespaces: []string{"ml"}, PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"snapshot": "allowed"}}},
+	}})
+	pod := func(labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod-0", Labels: labels}}
+	}
+	tests := []struct {
+		name          string
+		namespace     string
+		podNamespace  string
+		pod           *corev1.Pod
+		wantViolation bool
+	}{
+		{name: "own namespace", namespace: "team-a", podNamespace: "team-a"},
+		{name: "pod namespace defaults to own namespace", namespace: "team-a"},
+		{name: "other namespace without podNamespaces", namespace: "team-a", podNamespace: "team-b", wantViolation: true},
+		{name: "listed pod namespace", namespace: "ops", podNamespace: "team-b"},
+		{name: "unlisted pod namespace", namespace: "ops", podNamespace: "kube-system", wantViolation: true},
+		{name: "no rule for namespace", namespace: "default", wantViolation: true},
+		{name: "selector not checked before the pod is resolved", namespace: "ml"},
+		{name: "selector matches", namespace: "ml", pod: pod(map[string]string{"snapshot": "allowed"})},
+		{name: "selector does not match", namespace: "ml", pod: pod(map[string]string{"app": "db"}), wantViolation: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := newBuilder(tt.namespace, v1.ImageBuilderSpec{Namespace: tt.podNamespace})
+			checkViolation(t, checkNamespaces(&policy, builder, tt.pod), tt.wantViolation)
+		})
+	}
+}
+
+func TestCheckInsecure(t *testing.T) {
+	policies := []v1.ImageBuilderPolicy{
+		newPolicy("a", v1.ImageBuilderPolicySpec{}),
+		newPolicy("b", v1.ImageBuilderPolicySpec{InsecureRegistries: []string{"registry.local:5000", "*.lab.example.com"}}),
+	}
+	tests := []struct {
+		name          string
+		destination   v1.Destination
+		wantViolation bool
+	}{
+		{name: "verified TLS", destination: v1.Destination{To: "registry.example.com/a:v1"}},
+		{name: "plain HTTP to a listed registry", destination: v1.Destination{To: "registry.local:5000/a:v1", TLS: &v1.RegistryTLS{PlainHTTP: true}}},
+		{name: "skip verify with glob", destination: v1.Destination{To: "r1.lab.example.com/a:v1", TLS: &v1.RegistryTLS{InsecureSkipVerify: true}}},
+		{name: "listed host without its port", destination: v1.Destination{To: "registry.local/a:v1", TLS: &v1.RegistryTLS{PlainHTTP: true}}, wantViolation: true},
+		{name: "unlisted registry", destination: v1.Destination{To: "registry.example.com/a:v1", TLS: &v1.RegistryTLS{InsecureSkipVerify: true}}, wantViolation: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkViolation(t, checkInsecure(policies, tt.destination), tt.wantViolation)
+		})
+	}
+
+	if err := checkInsecure(nil, v1.Destination{To: "registry.local:5000/a:v1", TLS: &v1.RegistryTLS{PlainHTTP: true}}); err == nil {
+		t.Errorf("plain HTTP without any policy got no error")
+	}
+}
+
+func TestCheckSpec(t *testing.T) {
+	policies := []v1.ImageBuilderPolicy{
+		newPolicy("destinations", v1.ImageBuilderPolicySpec{AllowedDestinations: []string{"registry.example.com/*"}}),
+	}
+	tests := []struct {
+		name          string
+		spec          v1.ImageBuilderSpec
+		wantViolation bool
+	}{
+		{name: "allowed to", spec: v1.ImageBuilderSpec{To: "registry.example.com/app:v1"}},
+		{name: "denied to", spec: v1.ImageBuilderSpec{To: "docker.io/app:v1"}, wantViolation: true},
+		{name: "every destination is checked", spec: v1.ImageBuilderSpec{Destinations: []v1.Destination{
+			{To: "registry.example.com/app:v1"}, {To: "docker.io/app:v1"},
+		}}, wantViolation: true},
+		{name: "insecure destination", spec: v1.ImageBuilderSpec{Destinations: []v1.Destination{
+			{To: "registry.example.com/app:v1", TLS: &v1.RegistryTLS{PlainHTTP: true}},
+		}}, wantViolation: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkViolation(t, CheckSpec(policies, newBuilder("default", tt.spec), nil), tt.wantViolation)
+		})
+	}
+}
+
+func TestCheckImageSize(t *testing.T) {
+	limit := resource.MustParse("1Gi")
+	policies := []v1.ImageBuilderPolicy{
+		newPolicy("no-limit", v1.ImageBuilderPolicySpec{}),
+		newPolicy("size", v1.ImageBuilderPolicySpec{MaxImageSize: &limit}),
+	}
+	tests := []struct {
+		name          string
+		policies      []v1.ImageBuilderPolicy
+		size          int64
+		wantViolation bool
+	}{
+		{name: "below the limit", policies: policies, size: 512 << 20},
+		{name: "at the limit", policies: policies, size: 1 << 30},
+		{name: "above the limit", policies: policies, size: 1<<30 + 1, wantViolation: true},
+		{name: "unknown size with a limit", policies: policies, size: -1, wantViolation: true},
+		{name: "unknown size without a limit", policies: policies[:1], size: -1},
+		{name: "no policies", size: 100 << 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkViolation(t, CheckImageSize(tt.policies, tt.size), tt.wantViolation)
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	imagebuilderv1 "imagebuilder/api/v1"
+	"imagebuilder/pkg/core"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// objectRef is a Secret or ConfigMap the builder job reads on behalf of the creator of an ImageBuilder.
+type objectRef struct {
+	resource string
+	name     string
+	path     *field.Path
+}
+
+// referencedObjects returns the Secrets and ConfigMaps read from the namespace of the ImageBuilder.
+func referencedObjects(spec *imagebuilderv1.ImageBuilderSpec, fldPath *field.Path) []objectRef {
+	var refs []objectRef
+	secret := func(name string, path *field.Path) {
+		refs = append(refs, objectRef{resource: "secrets", name: name, path: path})
+	}
+	configMap := func(name string, path *field.Path) {
+		refs = append(refs, objectRef{resource: "configmaps", name: name, path: path})
+	}
+	registryTLS := func(tls *imagebuilderv1.RegistryTLS, path *field.Path) {
+		if tls == nil {
+			return
+		}
+		if tls.CA != nil && tls.CA.SecretKeyRef != nil {
+			secret(tls.CA.SecretKeyRef.Name, path.Child("ca", "secretKeyRef"))
+		}
+		if tls.CA != nil && tls.CA.ConfigMapKeyRef != nil {
+			configMap(tls.CA.ConfigMapKeyRef.Name, path.Child("ca", "configMapKeyRef"))
+		}
+		if tls.ClientCertSecretRef != nil {
+			secret(tls.ClientCertSecretRef.Name, path.Child("clientCertSecretRef"))
+		}
+	}
+
+	if spec.CredentialsSecretRef != nil {
+		secret(spec.CredentialsSecretRef.Name, fldPath.Child("credentialsSecretRef"))
+	}
+	registryTLS(spec.TLS, fldPath.Child("tls"))
+	for i, destination := range spec.Destinations {
+		idxPath := fldPath.Child("destinations").Index(i)
+		if destination.CredentialsSecretRef != nil {
+			secret(destination.CredentialsSecretRef.Name, idxPath.Child("credentialsSecretRef"))
+		}
+		registryTLS(destination.TLS, idxPath.Child("tls"))
+	}
+	for i, addFile := range spec.AddFiles {
+		idxPath := fldPath.Child("addFiles").Index(i)
+		if addFile.SecretKeyRef != nil {
+			secret(addFile.SecretKeyRef.Name, idxPath.Child("secretKeyRef"))
+		}
+		if addFile.ConfigMapKeyRef != nil {
+			configMap(addFile.ConfigMapKeyRef.Name, idxPath.Child("configMapKeyRef"))
+		}
+	}
+	return refs
+}
+
+// podPullSecrets returns the imagePullSecrets of the target pods of spec and of their
+// ServiceAccounts, the job pushes with them for usePodPullSecrets. A targetRef is reviewed with the
+// pod template of the workload and a selector with the pods matching it now.
+func podPullSecrets(ctx context.Context, reader client.Reader, namespace string, spec *imagebuilderv1.ImageBuilderSpec, path *field.Path) ([]objectRef, error) {
+	podNamespace := spec.Namespace
+	if podNamespace == "" {
+		podNamespace = namespace
+	}
+	var podSpecs []*corev1.PodSpec
+	switch {
+	case spec.PodName != "":
+		pod := &corev1.Pod{}
+		if err := reader.Get(ctx, client.ObjectKey{Namespace: podNamespace, Name: spec.PodName}, pod); err != nil {
+			return nil, err
+		}
+		podSpecs = append(podSpecs, &pod.Spec)
+	case spec.TargetRef != nil:
+		_, template, err := core.WorkloadPodTemplate(ctx, reader, podNamespace, spec.TargetRef)
+		if err != nil {
+			return nil, err
+		}
+		podSpecs = append(podSpecs, &template.Spec)
+	case spec.Selector != nil:
+		selector, err := metav1.LabelSelectorAsSelector(spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		pods := &corev1.PodList{}
+		if err = reader.List(ctx, pods, client.InNamespace(podNamespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, err
+		}
+		for i := range pods.Items {
+			podSpecs = append(podSpecs, &pods.Items[i].Spec)
+		}
+	}
+
+	var refs []objectRef
+	seen := map[string]bool{}
+	add := func(secrets []corev1.LocalObjectReference) {
+		for _, secret := range secrets {
+			if !seen[secret.Name] {
+				seen[secret.Name] = true
+				refs = append(refs, objectRef{resource: "secrets", name: secret.Name, path: path})
+			}
+		}
+	}
+	for _, podSpec := range podSpecs {
+		add(podSpec.ImagePullSecrets)
+		saName := podSpec.ServiceAccountName
+		if saName == "" {
+			saName = "default"
+		}
+		sa := &corev1.ServiceAccount{}
+		err := reader.Get(ctx, client.ObjectKey{Namespace: podNamespace, Name: saName}, sa)
+		if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		add(sa.ImagePullSecrets)
+	}
+	return refs, nil
+}
+
+// authorizeReferences checks with a SubjectAccessReview that the user of the admission request
+// may get every Secret and ConfigMap referenced by spec, including the pull secrets used for
+// usePodPullSecrets. The builder job reads them with the cluster wide role of the operator, without
+// the check any user able to create an ImageBuilder could copy a Secret of its namespace into an
+// image. It returns the references the user may not get.
+func authorizeReferences(ctx context.Context, c client.Client, reader client.Reader, namespace string, spec *imagebuilderv1.ImageBuilderSpec, fldPath *field.Path) (field.ErrorList, error) {
+	refs := referencedObjects(spec, fldPath)
+	if spec.UsePodPullSecrets {
+		path := fldPath.Child("usePodPullSecrets")
+		pullSecrets, err := podPullSecrets(ctx, reader, namespace, spec, path)
+		if err != nil {
+			return field.ErrorList{field.Forbidden(path, fmt.Sprintf("the pull secrets of the target pod can not be reviewed: %v", err))}, nil
+		}
+		refs = append(refs, pullSecrets...)
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	extra := map[string]authorizationv1.ExtraValue{}
+	for key, value := range req.UserInfo.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+
+	var errs field.ErrorList
+	for _, ref := range refs {
+		review := &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:   req.UserInfo.Username,
+				UID:    req.UserInfo.UID,
+				Groups: req.UserInfo.Groups,
+				Extra:  extra,
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: namespace,
+					Verb:      "get",
+					Resource:  ref.resource,
+					Name:      ref.name,
+				},
+			},
+		}
+		if err = c.Create(ctx, review); err != nil {
+			return nil, fmt.Errorf("review access to %s %s/%s: %w", ref.resource, namespace, ref.name, err)
+		}
+		if !review.Status.Allowed {
+			errs = append(errs, field.Forbidden(ref.path, fmt.Sprintf("user %s may not get %s %s/%s",
+				req.UserInfo.Username, ref.resource, namespace, ref.name)))
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"context"
+	imagebuilderv1 "imagebuilder/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestPodPullSecrets(t *testing.T) {
+	pullSecrets := func(names ...string) []corev1.LocalObjectReference {
+		var refs []corev1.LocalObjectReference
+		for _, name := range names {
+			refs = append(refs, corev1.LocalObjectReference{Name: name})
+		}
+		return refs
+	}
+	pod := func(name, serviceAccount string, labels map[string]string, secrets ...string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: name, Labels: labels},
+			Spec:       corev1.PodSpec{ServiceAccountName: serviceAccount, ImagePullSecrets: pullSecrets(secrets...)},
+		}
+	}
+	objects := []client.Object{
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "default"}, ImagePullSecrets: pullSecrets("default-pull")},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"}, ImagePullSecrets: pullSecrets("app-pull", "shared-pull")},
+		pod("pod-0", "", map[string]string{"app": "web"}, "pod-pull"),
+		pod("pod-1", "app", map[string]string{"app": "web"}, "shared-pull"),
+		pod("pod-2", "missing", nil),
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "api"},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{ServiceAccountName: "app", ImagePullSecrets: pullSecrets("api-pull")},
+			}},
+		},
+	}
+	reader := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objects...).Build()
+	path := field.NewPath("spec", "usePodPullSecrets")
+
+	tests := []struct {
+		name    string
+		spec    imagebuilderv1.ImageBuilderSpec
+		want    []string
+		wantErr bool
+	}{
+		{name: "pod and default service account", spec: imagebuilderv1.ImageBuilderSpec{PodName: "pod-0"}, want: []string{"pod-pull", "default-pull"}},
+		{name: "service account without pull secrets", spec: imagebuilderv1.ImageBuilderSpec{PodName: "pod-2"}},
+		{name: "missing pod", spec: imagebuilderv1.ImageBuilderSpec{PodName: "pod-9"}, wantErr: true},
+		{
+			name: "workload template",
+			spec: imagebuilderv1.ImageBuilderSpec{TargetRef: &imagebuilderv1.TargetReference{Kind: "Deployment", Name: "api"}},
+			want: []string{"api-pull", "app-pull", "shared-pull"},
+		},
+		{
+			name: "selector without duplicates",
+			spec: imagebuilderv1.ImageBuilderSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+			want: []string{"pod-pull", "default-pull", "shared-pull", "app-pull"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refs, err := podPullSecrets(context.Background(), reader, "team-a", &tt.spec, path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("podPullSecrets() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, ref := range refs {
+				if ref.resource != "secrets" || ref.path != path {
+					t.Errorf("podPullSecrets() returned %+v, want a secret at %s", ref, path)
+				}
+				got = append(got, ref.name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podPullSecrets() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
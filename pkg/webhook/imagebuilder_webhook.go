@@ -0,0 +1,395 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	imagebuilderv1 "imagebuilder/api/v1"
+	"imagebuilder/pkg/core"
+	"imagebuilder/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/klog/v2"
+	"path"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strings"
+)
+
+// deniedHostPaths are node directories a privileged builder job must never write into.
+var deniedHostPaths = []string{
+	"/bin", "/boot", "/dev", "/etc", "/lib", "/lib64", "/proc", "/root", "/run", "/sbin", "/sys", "/usr",
+	"/var/lib/containerd", "/var/lib/docker", "/var/lib/kubelet", "/var/run",
+}
+
+// SetupImageBuilderWebhookWithManager registers the defaulting and validating webhooks of ImageBuilder.
+func SetupImageBuilderWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&imagebuilderv1.ImageBuilder{}).
+		// pods are read uncached, the manager should not keep an informer on every pod of the cluster
+		WithDefaulter(&ImageBuilderDefaulter{Reader: mgr.GetAPIReader()}).
+		WithValidator(&ImageBuilderValidator{Client: mgr.GetClient(), Reader: mgr.GetAPIReader()}).
+		Complete()
+}
+
+// ImageBuilderDefaulter fills in the fields that can be inferred, so that the persisted
+// spec shows what will actually run.
+type ImageBuilderDefaulter struct {
+	Reader client.Reader
+}
+
+var _ admission.CustomDefaulter = &ImageBuilderDefaulter{}
+
+func (d *ImageBuilderDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	builder, ok := obj.(*imagebuilderv1.ImageBuilder)
+	if !ok {
+		return fmt.Errorf("expected an ImageBuilder but got %T", obj)
+	}
+
+	if builder.Spec.Namespace == "" {
+		builder.Spec.Namespace = builder.Namespace
+	}
+	if builder.Spec.Operator == "" && len(builder.Spec.Operations) == 0 {
+		builder.Spec.Operator = imagebuilderv1.Push
+	}
+	if builder.Spec.ContainerName == "" {
+		containers, err := d.targetContainers(ctx, &builder.Spec)
+		if err != nil {
+			// the validator reports the missing containerName
+			klog.Warningf("get target pod of %s/%s error: %v", builder.Namespace, builder.Name, err)
+			return nil
+		}
+		if len(containers) == 1 {
+			builder.Spec.ContainerName = containers[0].Name
+		}
+	}
+	return nil
+}
+
+// targetContainers returns the containers of the target pod, or of the pod template of a targetRef.
+func (d *ImageBuilderDefaulter) targetContainers(ctx context.Context, spec *imagebuilderv1.ImageBuilderSpec) ([]corev1.Container, error) {
+	if spec.PodName == "" && spec.TargetRef != nil {
+		_, template, err := core.WorkloadPodTemplate(ctx, d.Reader, spec.Namespace, spec.TargetRef)
+		if err != nil {
+			return nil, err
+		}
+		return template.Spec.Containers, nil
+	}
+	pod, err := core.ResolveTargetPod(ctx, d.Reader, spec)
+	if err != nil {
+		return nil, err
+	}
+	return pod.Spec.Containers, nil
+}
+
+// ImageBuilderValidator rejects invalid ImageBuilder specs and specs denied by an
+// ImageBuilderPolicy at admission time.
+type ImageBuilderValidator struct {
+	// Client reads the policies and creates the SubjectAccessReviews of referenced Secrets.
+	Client client.Client
+	// Reader reads the target pod and its ServiceAccount uncached for usePodPullSecrets.
+	Reader client.Reader
+}
+
+var _ admission.CustomValidator = &ImageBuilderValidator{}
+
+func (v *ImageBuilderValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	builder, ok := obj.(*imagebuilderv1.ImageBuilder)
+	if !ok {
+		return nil, fmt.Errorf("expected an ImageBuilder but got %T", obj)
+	}
+	return v.validate(ctx, builder)
+}
+
+// ValidateUpdate only checks spec changes, metadata edits of ImageBuilders created before the
+// webhook or a stricter policy must still pass. The spec is immutable once the build started.
+func (v *ImageBuilderValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	builder, ok := newObj.(*imagebuilderv1.ImageBuilder)
+	if !ok {
+		return nil, fmt.Errorf("expected an ImageBuilder but got %T", newObj)
+	}
+	old, ok := oldObj.(*imagebuilderv1.ImageBuilder)
+	if !ok {
+		return nil, fmt.Errorf("expected an ImageBuilder but got %T", oldObj)
+	}
+	if equality.Semantic.DeepEqual(old.Spec, builder.Spec) {
+		return nil, nil
+	}
+	if old.Status.State != "" {
+		return nil, apierrors.NewInvalid(imagebuilderv1.GroupVersion.WithKind("ImageBuilder").GroupKind(), builder.Name, field.ErrorList{
+			field.Forbidden(field.NewPath("spec"), fmt.Sprintf("the build is %s, the spec can not be changed anymore", old.Status.State)),
+		})
+	}
+	return v.validate(ctx, builder)
+}
+
+func (v *ImageBuilderValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *ImageBuilderValidator) validate(ctx context.Context, builder *imagebuilderv1.ImageBuilder) (admission.Warnings, error) {
+	var warnings admission.Warnings
+	if builder.Spec.Username != "" || builder.Spec.Password != "" {
+		warnings = append(warnings, "spec.username and spec.password are deprecated, use spec.credentialsSecretRef")
+	}
+
+	errs := ValidateImageBuilderSpec(&builder.Spec, field.NewPath("spec"))
+	if builder.Spec.UsePodPullSecrets && builder.Spec.Namespace != builder.Namespace {
+		// the pull secrets of another namespace must not be usable by the creator of the ImageBuilder
+		errs = append(errs, field.Invalid(field.NewPath("spec", "usePodPullSecrets"), true,
+			"the target pod must be in the namespace of the ImageBuilder"))
+	}
+	if len(errs) > 0 {
+		return warnings, apierrors.NewInvalid(imagebuilderv1.GroupVersion.WithKind("ImageBuilder").GroupKind(), builder.Name, errs)
+	}
+
+	groupResource := imagebuilderv1.GroupVersion.WithResource("imagebuilders").GroupResource()
+	denied, err := authorizeReferences(ctx, v.Client, v.Reader, builder.Namespace, &builder.Spec, field.NewPath("spec"))
+	if err != nil {
+		return warnings, err
+	}
+	if len(denied) > 0 {
+		return warnings, apierrors.NewForbidden(groupResource, builder.Name, denied.ToAggregate())
+	}
+
+	policies, err := policy.List(ctx, v.Client)
+	if err != nil {
+		return warnings, err
+	}
+	if err = policy.CheckSpec(policies, builder, nil); err != nil {
+		return warnings, apierrors.NewForbidden(groupResource, builder.Name, err)
+	}
+	return warnings, nil
+}
+
+// ValidateImageBuilderSpec checks the spec the same way the builder job will interpret it.
+func ValidateImageBuilderSpec(spec *imagebuilderv1.ImageBuilderSpec, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	errs = append(errs, validateTarget(spec, fldPath)...)
+	if spec.ContainerName == "" {
+		errs = append(errs, field.Required(fldPath.Child("containerName"), ""))
+	}
+	if spec.Namespace != "" {
+		for _, msg := range validation.IsDNS1123Label(spec.Namespace) {
+			errs = append(errs, field.Invalid(fldPath.Child("namespace"), spec.Namespace, msg))
+		}
+	}
+
+	if len(spec.Destinations) == 0 || spec.To != "" {
+		errs = append(errs, validateReference(spec.To, fldPath.Child("to"))...)
+	}
+	for i, destination := range spec.Destinations {
+		idxPath := fldPath.Child("destinations").Index(i)
+		errs = append(errs, validateReference(destination.To, idxPath.Child("to"))...)
+		if destination.CredentialsSecretRef != nil && destination.CredentialsSecretRef.Name == "" {
+			errs = append(errs, field.Required(idxPath.Child("credentialsSecretRef", "name"), ""))
+		}
+		errs = append(errs, validateRegistryTLS(destination.TLS, idxPath.Child("tls"))...)
+	}
+	errs = append(errs, validateRegistryTLS(spec.TLS, fldPath.Child("tls"))...)
+	if len(spec.Destinations) > 0 && !spec.HasOperation(imagebuilderv1.Push) {
+		errs = append(errs, field.Invalid(fldPath.Child("destinations"), "", "destinations are only pushed, the operations do not push"))
+	}
+
+	supported := []string{string(imagebuilderv1.Push), string(imagebuilderv1.Save), string(imagebuilderv1.ExportRootfs)}
+	switch spec.Operator {
+	case "", imagebuilderv1.Push, imagebuilderv1.Save, imagebuilderv1.ExportRootfs:
+	default:
+		errs = append(errs, field.NotSupported(fldPath.Child("operator"), spec.Operator, supported))
+	}
+	operations := map[imagebuilderv1.OperatorType]bool{}
+	for i, operation := range spec.Operations {
+		switch operation {
+		case imagebuilderv1.Push, imagebuilderv1.Save, imagebuilderv1.ExportRootfs:
+		default:
+			errs = append(errs, field.NotSupported(fldPath.Child("operations").Index(i), operation, supported))
+		}
+		if operations[operation] {
+			errs = append(errs, field.Duplicate(fldPath.Child("operations").Index(i), operation))
+		}
+		operations[operation] = true
+	}
+
+	errs = append(errs, validateHostPath(string(spec.LocalHostPath), fldPath.Child("localHostPath"))...)
+
+	if spec.CredentialsSecretRef != nil && spec.CredentialsSecretRef.Name == "" {
+		errs = append(errs, field.Required(fldPath.Child("credentialsSecretRef", "name"), ""))
+	}
+	errs = append(errs, validateRetryPolicy(spec.RetryPolicy, fldPath.Child("retryPolicy"))...)
+	if spec.Commit != nil {
+		for i, change := range spec.Commit.Changes {
+			if err := core.ApplyChanges(&ocispec.ImageConfig{}, []string{change}); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("commit", "changes").Index(i), change, err.Error()))
+			}
+		}
+		for i, pattern := range spec.Commit.ExcludePaths {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("commit", "excludePaths").Index(i), pattern, err.Error()))
+			} else if !path.IsAbs(pattern) {
+				errs = append(errs, field.Invalid(fldPath.Child("commit", "excludePaths").Index(i), pattern, "must be an absolute path"))
+			}
+		}
+		for i, pattern := range spec.Commit.KeepEnv {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("commit", "keepEnv").Index(i), pattern, err.Error()))
+			}
+		}
+		errs = append(errs, validateCommitHook(spec.Commit.PreCommitHook, fldPath.Child("commit", "preCommitHook"))...)
+		errs = append(errs, validateCommitHook(spec.Commit.PostCommitHook, fldPath.Child("commit", "postCommitHook"))...)
+	}
+	for i, addFile := range spec.AddFiles {
+		idxPath := fldPath.Child("addFiles").Index(i)
+		if !path.IsAbs(addFile.Path) || path.Clean(addFile.Path) == "/" {
+			errs = append(errs, field.Invalid(idxPath.Child("path"), addFile.Path, "must be an absolute file path"))
+		}
+		if addFile.Mode != nil && (*addFile.Mode < 0 || *addFile.Mode > 07777) {
+			errs = append(errs, field.Invalid(idxPath.Child("mode"), *addFile.Mode, "must be between 0 and 07777"))
+		}
+		if (addFile.ConfigMapKeyRef == nil) == (addFile.SecretKeyRef == nil) {
+			errs = append(errs, field.Invalid(idxPath, addFile.Path, "exactly one of configMapKeyRef and secretKeyRef must be set"))
+		}
+	}
+	if spec.Timeout != nil && spec.Timeout.Duration <= 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("timeout"), spec.Timeout.Duration.String(), "must be greater than 0"))
+	}
+	if ttl := spec.TTLSecondsAfterFinished; ttl != nil && *ttl < 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("ttlSecondsAfterFinished"), *ttl, "must be greater than or equal to 0"))
+	}
+	return errs
+}
+
+// validateTarget requires exactly one of podName, targetRef and selector.
+func validateTarget(spec *imagebuilderv1.ImageBuilderSpec, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	set := 0
+	if spec.PodName != "" {
+		set++
+	}
+	if spec.Selector != nil {
+		set++
+		if _, err := metav1.LabelSelectorAsSelector(spec.Selector); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("selector"), spec.Selector, err.Error()))
+		} else if len(spec.Selector.MatchLabels) == 0 && len(spec.Selector.MatchExpressions) == 0 {
+			errs = append(errs, field.Invalid(fldPath.Child("selector"), spec.Selector, "selector must not be empty"))
+		}
+	}
+	if ref := spec.TargetRef; ref != nil {
+		set++
+		refPath := fldPath.Child("targetRef")
+		switch ref.Kind {
+		case core.KindDeployment, core.KindReplicaSet:
+			if ref.Ordinal != nil {
+				errs = append(errs, field.Forbidden(refPath.Child("ordinal"), "only supported for StatefulSet"))
+			}
+		case core.KindStatefulSet:
+			if ref.Ordinal != nil && *ref.Ordinal < 0 {
+				errs = append(errs, field.Invalid(refPath.Child("ordinal"), *ref.Ordinal, "must be greater than or equal to 0"))
+			}
+		default:
+			errs = append(errs, field.NotSupported(refPath.Child("kind"), ref.Kind,
+				[]string{core.KindDeployment, core.KindStatefulSet, core.KindReplicaSet}))
+		}
+		if ref.Name == "" {
+			errs = append(errs, field.Required(refPath.Child("name"), ""))
+		}
+	}
+	switch set {
+	case 0:
+		errs = append(errs, field.Required(fldPath.Child("podName"), "one of podName, targetRef or selector is required"))
+	case 1:
+	default:
+		errs = append(errs, field.Forbidden(fldPath, "only one of podName, targetRef or selector may be set"))
+	}
+	return errs
+}
+
+func validateRetryPolicy(policy *imagebuilderv1.RetryPolicy, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if policy == nil {
+		return errs
+	}
+	if policy.MaxAttempts < 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("maxAttempts"), policy.MaxAttempts, "must be greater than or equal to 0"))
+	}
+	if policy.Backoff != nil && policy.Backoff.Duration < 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("backoff"), policy.Backoff.Duration.String(), "must not be negative"))
+	}
+	return errs
+}
+
+func validateRegistryTLS(registryTLS *imagebuilderv1.RegistryTLS, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if registryTLS == nil {
+		return errs
+	}
+	if registryTLS.PlainHTTP && registryTLS.InsecureSkipVerify {
+		errs = append(errs, field.Invalid(fldPath, "", "plainHTTP and insecureSkipVerify are mutually exclusive"))
+	}
+	if registryTLS.PlainHTTP && (registryTLS.CA != nil || registryTLS.ClientCertSecretRef != nil) {
+		errs = append(errs, field.Invalid(fldPath, "", "ca and clientCertSecretRef require TLS, not plainHTTP"))
+	}
+	if ca := registryTLS.CA; ca != nil && (ca.ConfigMapKeyRef == nil) == (ca.SecretKeyRef == nil) {
+		errs = append(errs, field.Invalid(fldPath.Child("ca"), "", "exactly one of configMapKeyRef and secretKeyRef must be set"))
+	}
+	if ref := registryTLS.ClientCertSecretRef; ref != nil && ref.Name == "" {
+		errs = append(errs, field.Required(fldPath.Child("clientCertSecretRef", "name"), ""))
+	}
+	return errs
+}
+
+func validateCommitHook(hook *imagebuilderv1.CommitHook, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if hook == nil {
+		return errs
+	}
+	if len(hook.Command) == 0 || hook.Command[0] == "" {
+		errs = append(errs, field.Required(fldPath.Child("command"), ""))
+	}
+	if hook.Timeout != nil && hook.Timeout.Duration <= 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("timeout"), hook.Timeout.Duration.String(), "must be greater than 0"))
+	}
+	return errs
+}
+
+// validateReference parses to with the same parser the push uses. The committed image needs a tag,
+// a digest reference cannot be committed to.
+func validateReference(to string, fldPath *field.Path) field.ErrorList {
+	if to == "" {
+		return field.ErrorList{field.Required(fldPath, "")}
+	}
+	named, err := refdocker.ParseDockerRef(to)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, to, err.Error())}
+	}
+	if _, ok := named.(refdocker.Digested); ok {
+		return field.ErrorList{field.Invalid(fldPath, to, "digest references can not be committed to, use a tag")}
+	}
+	return nil
+}
+
+func validateHostPath(hostPath string, fldPath *field.Path) field.ErrorList {
+	if hostPath == "" {
+		return nil
+	}
+	if !path.IsAbs(hostPath) {
+		return field.ErrorList{field.Invalid(fldPath, hostPath, "must be an absolute path")}
+	}
+	cleaned := path.Clean(hostPath)
+	if cleaned == "/" || cleaned == "/var" {
+		return field.ErrorList{field.Forbidden(fldPath, fmt.Sprintf("%s is a system directory", cleaned))}
+	}
+	for _, denied := range deniedHostPaths {
+		if cleaned == denied || strings.HasPrefix(cleaned, denied+"/") {
+			return field.ErrorList{field.Forbidden(fldPath, fmt.Sprintf("%s is a system directory", denied))}
+		}
+	}
+	return nil
+}
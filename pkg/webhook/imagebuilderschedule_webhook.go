@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	imagebuilderv1 "imagebuilder/api/v1"
+	"imagebuilder/pkg/core"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"text/template"
+)
+
+// SetupImageBuilderScheduleWebhookWithManager registers the validating webhook of ImageBuilderSchedule.
+func SetupImageBuilderScheduleWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&imagebuilderv1.ImageBuilderSchedule{}).
+		WithValidator(&ImageBuilderScheduleValidator{Client: mgr.GetClient(), Reader: mgr.GetAPIReader()}).
+		Complete()
+}
+
+// maxScheduleNameLength keeps the run names "<schedule>-<minutes since the epoch>" valid label values.
+const maxScheduleNameLength = validation.LabelValueMaxLength - 9
+
+// ImageBuilderScheduleValidator rejects schedules that could never create a valid ImageBuilder.
+type ImageBuilderScheduleValidator struct {
+	// Client creates the SubjectAccessReviews of the Secrets referenced by the template, the runs
+	// are created by the operator.
+	Client client.Client
+	// Reader reads the target pods and their ServiceAccounts uncached for usePodPullSecrets.
+	Reader client.Reader
+}
+
+var _ admission.CustomValidator = &ImageBuilderScheduleValidator{}
+
+func (v *ImageBuilderScheduleValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	schedule, ok := obj.(*imagebuilderv1.ImageBuilderSchedule)
+	if !ok {
+		return nil, fmt.Errorf("expected an ImageBuilderSchedule but got %T", obj)
+	}
+	return nil, v.validate(ctx, schedule)
+}
+
+func (v *ImageBuilderScheduleValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	schedule, ok := newObj.(*imagebuilderv1.ImageBuilderSchedule)
+	if !ok {
+		return nil, fmt.Errorf("expected an ImageBuilderSchedule but got %T", newObj)
+	}
+	return nil, v.validate(ctx, schedule)
+}
+
+func (v *ImageBuilderScheduleValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *ImageBuilderScheduleValidator) validate(ctx context.Context, schedule *imagebuilderv1.ImageBuilderSchedule) error {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if len(schedule.Name) > maxScheduleNameLength {
+		errs = append(errs, field.TooLong(field.NewPath("metadata", "name"), schedule.Name, maxScheduleNameLength))
+	}
+
+	if _, err := core.ParseSchedule(schedule.Spec.Schedule); err != nil {
+		errs = append(errs, field.Invalid(specPath.Child("schedule"), schedule.Spec.Schedule, err.Error()))
+	}
+	if schedule.Spec.TagTemplate != "" {
+		if _, err := template.New("tag").Parse(schedule.Spec.TagTemplate); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("tagTemplate"), schedule.Spec.TagTemplate, err.Error()))
+		}
+	}
+	if limit := schedule.Spec.SuccessfulHistoryLimit; limit != nil && *limit < 0 {
+		errs = append(errs, field.Invalid(specPath.Child("successfulHistoryLimit"), *limit, "must be greater than or equal to 0"))
+	}
+	if limit := schedule.Spec.FailedHistoryLimit; limit != nil && *limit < 0 {
+		errs = append(errs, field.Invalid(specPath.Child("failedHistoryLimit"), *limit, "must be greater than or equal to 0"))
+	}
+	errs = append(errs, ValidateImageBuilderSpec(&schedule.Spec.Template.Spec, specPath.Child("template", "spec"))...)
+
+	if len(errs) > 0 {
+		return apierrors.NewInvalid(imagebuilderv1.GroupVersion.WithKind("ImageBuilderSchedule").GroupKind(), schedule.Name, errs)
+	}
+
+	denied, err := authorizeReferences(ctx, v.Client, v.Reader, schedule.Namespace, &schedule.Spec.Template.Spec, specPath.Child("template", "spec"))
+	if err != nil {
+		return err
+	}
+	if len(denied) > 0 {
+		return apierrors.NewForbidden(imagebuilderv1.GroupVersion.WithResource("imagebuilderschedules").GroupResource(), schedule.Name, denied.ToAggregate())
+	}
+	return nil
+}